@@ -2,10 +2,15 @@ package sparta
 
 import (
 	"bytes"
-	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
-	"text/template"
+	"sync"
 
 	// Also included in lambda_permissions.go, but doubly included
 	// here as the package's init() function handles registering
@@ -13,136 +18,1308 @@ import (
 	_ "github.com/mweagle/cloudformationresources"
 
 	"github.com/Sirupsen/logrus"
+	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
 	gocf "github.com/mweagle/go-cloudformation"
 )
 
-// resourceOutputs is responsible for returning the conditional
-// set of CloudFormation outputs for a given resource type.
-func resourceOutputs(resourceName string,
-	resource gocf.ResourceProperties,
-	logger *logrus.Logger) ([]string, error) {
+// resourcePropertiesValue returns the non-pointer form of the resource
+// so that resources added to a template by reference (eg, &gocf.S3Bucket{})
+// are handled the same as those added by value. Nil pointers return nil.
+func resourcePropertiesValue(resource gocf.ResourceProperties) gocf.ResourceProperties {
+	resourceValue := reflect.ValueOf(resource)
+	if resourceValue.Kind() != reflect.Ptr {
+		return resource
+	}
+	if resourceValue.IsNil() {
+		return nil
+	}
+	elemResource, elemResourceOk := resourceValue.Elem().Interface().(gocf.ResourceProperties)
+	if !elemResourceOk {
+		return resource
+	}
+	return elemResource
+}
+
+// StrictDiscovery causes provisioning to fail, rather than log a warning,
+// when a DependsOn resource type doesn't publish discovery information.
+// Defaults to false.
+var StrictDiscovery = false
+
+// UnsupportedResourceFunc is called with the logical name and CloudFormation
+// type of a DependsOn resource that doesn't publish discovery information
+type UnsupportedResourceFunc func(resourceName string, resourceType string)
+
+// UnsupportedResourceHandler, if non-nil, is called rather than logging a
+// warning when a DependsOn resource type doesn't publish discovery
+// information. It isn't called if StrictDiscovery is enabled.
+var UnsupportedResourceHandler UnsupportedResourceFunc
+
+// DiscoveryEnvironmentKey is the default environment key for the
+// sparta.Discover information. It must be assigned the same value
+// when provisioning and in the AWS Lambda binary.
+var DiscoveryEnvironmentKey = spartaEnvVarDiscoveryInformation
+
+// setDiscoveryEnvironment assigns the discovery information to the
+// environment. If environmentKey isn't the default key, it's also
+// published so that sparta.Discover can find the information. An error
+// is returned rather than replacing an existing environment variable, or
+// if the key is empty or the reserved key that publishes a non-default key.
+func setDiscoveryEnvironment(environmentVars map[string]*gocf.StringExpr,
+	environmentKey string,
+	discoveryInfo *gocf.StringExpr) error {
+	if environmentKey == "" {
+		environmentKey = DiscoveryEnvironmentKey
+	}
+	if environmentKey == "" {
+		return fmt.Errorf("DiscoveryEnvironmentKey must not be empty")
+	}
+	if environmentKey == spartaEnvVarDiscoveryKey {
+		return fmt.Errorf("Discovery environment key %s is reserved", environmentKey)
+	}
+	publishedKeys := []string{environmentKey}
+	if environmentKey != DiscoveryEnvironmentKey {
+		publishedKeys = append(publishedKeys, spartaEnvVarDiscoveryKey)
+	}
+	for _, eachKey := range publishedKeys {
+		if _, exists := environmentVars[eachKey]; exists {
+			return fmt.Errorf("Discovery environment variable %s is already defined", eachKey)
+		}
+	}
+	environmentVars[environmentKey] = discoveryInfo
+	if environmentKey != DiscoveryEnvironmentKey {
+		environmentVars[spartaEnvVarDiscoveryKey] = gocf.String(environmentKey)
+	}
+	return nil
+}
+
+// discoveryEnvironmentKey returns the environment key that includes
+// the discovery information
+func discoveryEnvironmentKey(environmentVars map[string]*gocf.StringExpr) string {
+	keyExpr := environmentVars[spartaEnvVarDiscoveryKey]
+	if keyExpr != nil && keyExpr.Func == nil && keyExpr.Literal != "" {
+		return keyExpr.Literal
+	}
+	return DiscoveryEnvironmentKey
+}
 
+// DiscoverableResource is implemented by ResourceProperties types, such as
+// custom resources, that publish Fn::GetAtt attributes as discovery
+// information
+type DiscoverableResource interface {
+	// DiscoverableOutputs returns the Fn::GetAtt attribute names
+	DiscoverableOutputs() []string
+}
+
+// NestedStack is an AWS::CloudFormation::Stack resource whose child
+// template Outputs are published as discovery information. The child
+// template is only referenced by TemplateURL, so the output names must
+// be declared.
+type NestedStack struct {
+	gocf.CloudFormationStack
+	// Names of the Outputs declared by the nested stack's template
+	Outputs []string `json:"-"`
+}
+
+// DiscoverableOutputs returns the Outputs.<Name> attribute for each
+// declared output
+func (stack NestedStack) DiscoverableOutputs() []string {
+	outputProps := make([]string, 0, len(stack.Outputs))
+	for _, eachOutput := range stack.Outputs {
+		outputProps = append(outputProps, fmt.Sprintf("Outputs.%s", eachOutput))
+	}
+	return outputProps
+}
+
+// ResourceOutputsFunc returns the Fn::GetAtt attribute names that should be
+// published as discovery information for the given resource. Resources
+// that were added to the template by reference are passed by value.
+type ResourceOutputsFunc func(resource gocf.ResourceProperties) []string
+
+// registeredOutputs is the set of user supplied ResourceOutputsFunc values,
+// keyed by CloudFormation resource type
+type registeredOutputs struct {
+	sync.RWMutex
+	outputFuncs   map[string]ResourceOutputsFunc
+	overrideFuncs map[string]ResourceOutputsFunc
+}
+
+func (registered *registeredOutputs) lookup(resourceType string,
+	override bool) (ResourceOutputsFunc, bool) {
+	registered.RLock()
+	defer registered.RUnlock()
+	if override {
+		outputFunc, outputFuncOk := registered.overrideFuncs[resourceType]
+		return outputFunc, outputFuncOk
+	}
+	outputFunc, outputFuncOk := registered.outputFuncs[resourceType]
+	return outputFunc, outputFuncOk
+}
+
+var registeredResourceOutputs = &registeredOutputs{
+	outputFuncs:   make(map[string]ResourceOutputsFunc),
+	overrideFuncs: make(map[string]ResourceOutputsFunc),
+}
+
+// RegisterResourceOutputs registers a function that returns the Fn::GetAtt
+// attribute names to publish as discovery information for resourceType
+// (eg, "Custom::MyResource"). Resource types that Sparta already supports
+// continue to use the built-in attributes. See OverrideResourceOutputs
+// to replace a built-in definition. It's safe to call from an init() function.
+func RegisterResourceOutputs(resourceType string, outputsFunc ResourceOutputsFunc) {
+	registeredResourceOutputs.Lock()
+	defer registeredResourceOutputs.Unlock()
+	registeredResourceOutputs.outputFuncs[resourceType] = outputsFunc
+}
+
+// OverrideResourceOutputs registers a function that returns the Fn::GetAtt
+// attribute names to publish as discovery information for resourceType.
+// Unlike RegisterResourceOutputs, the function takes precedence over the
+// built-in attributes for resource types Sparta already supports.
+func OverrideResourceOutputs(resourceType string, outputsFunc ResourceOutputsFunc) {
+	registeredResourceOutputs.Lock()
+	defer registeredResourceOutputs.Unlock()
+	registeredResourceOutputs.overrideFuncs[resourceType] = outputsFunc
+}
+
+// DiscoveryTransformFunc returns the discovery properties to publish for a
+// dependency. The properties map values are JSON string escaped literals
+// (without the enclosing quotes) that may include inline CloudFormation
+// expressions (eg, { "Ref" : "MyResource" }) that are resolved when the
+// stack is provisioned. The returned keys and values must use the same
+// form, so literal quotes and backslashes must be escaped (eg, by
+// removing the enclosing quotes from the json.Marshal result). The
+// returned map is merged with the existing properties, so it only needs
+// to include new or updated keys. The properties map is a copy, so
+// changes to it aren't published.
+type DiscoveryTransformFunc func(resourceName string,
+	resourceType string,
+	properties map[string]string) map[string]string
+
+var registeredDiscoveryTransforms struct {
+	sync.RWMutex
+	transforms []DiscoveryTransformFunc
+}
+
+// RegisterDiscoveryTransform registers a function that can add or replace
+// the discovery properties for every dependency. Transforms are applied
+// in registration order after the built-in properties are computed.
+// It's safe to call from an init() function.
+func RegisterDiscoveryTransform(transform DiscoveryTransformFunc) {
+	registeredDiscoveryTransforms.Lock()
+	defer registeredDiscoveryTransforms.Unlock()
+	registeredDiscoveryTransforms.transforms = append(registeredDiscoveryTransforms.transforms,
+		transform)
+}
+
+// resourceTypeOutputs returns the Fn::GetAtt attribute names for resource types
+// that don't have a go-cloudformation definition. These resources are
+// identified by their CloudFormation type name, so they're provided as a
+// user-defined gocf.ResourceProperties struct whose CfnResourceType returns
+// the AWS type name (eg, "AWS::SecretsManager::Secret") and whose fields
+// marshal to the resource's Properties. A gocf.CloudFormationCustomResource
+// with a ResourceTypeName can't be used, since ResourceTypeName would be
+// serialized as a resource property. The boolean result is false if the
+// resource type isn't supported.
+func resourceTypeOutputs(resourceType string) ([]string, bool) {
+	switch resourceType {
+	case "AWS::ApiGatewayV2::Api":
+		return []string{"ApiEndpoint"}, true
+	case "AWS::AppConfig::Application",
+		"AWS::AppConfig::ConfigurationProfile",
+		"AWS::AppConfig::Environment":
+		return []string{}, true
+	case "AWS::AppSync::GraphQLApi":
+		return []string{"ApiId", "Arn", "GraphQLUrl"}, true
+	case "AWS::CloudWatch::CompositeAlarm":
+		return []string{"Arn"}, true
+	case "AWS::Events::EventBus":
+		return []string{"Arn", "Name"}, true
+	case "AWS::KinesisAnalyticsV2::Application":
+		return []string{}, true
+	case "AWS::Lambda::LayerVersion":
+		return []string{}, true
+	case "AWS::MSK::Cluster", "AWS::MSK::ServerlessCluster":
+		// The bootstrap brokers aren't attributes and must be read
+		// at runtime via the GetBootstrapBrokers API
+		return []string{"Arn"}, true
+	case "AWS::Neptune::DBCluster":
+		return []string{"Endpoint", "Port", "ReadEndpoint"}, true
+	case "AWS::SecretsManager::Secret":
+		return []string{}, true
+	case "AWS::Timestream::Database":
+		return []string{"Arn"}, true
+	case "AWS::Timestream::Table":
+		// The Ref value combines the database and table names
+		return []string{"Arn", "Name"}, true
+	case "AWS::WAFv2::WebACL":
+		return []string{"Arn", "Id"}, true
+	}
+	return nil, false
+}
+
+// resourceOutputsLookup returns the Fn::GetAtt attribute names, in sorted
+// order, that are published as discovery information for the resource.
+// The boolean result is false if the resource type doesn't publish
+// discovery information. Unlike resourceOutputs, it doesn't log,
+// honor StrictDiscovery, or call the UnsupportedResourceHandler.
+func resourceOutputsLookup(resource gocf.ResourceProperties) ([]string, bool) {
+	resourceValue := resourcePropertiesValue(resource)
+	if resourceValue == nil {
+		return nil, false
+	}
 	outputProps := []string{}
-	switch typedResource := resource.(type) {
+	overrideFunc, overrideFuncOk := registeredResourceOutputs.lookup(resourceValue.CfnResourceType(), true)
+	if overrideFuncOk {
+		outputProps = append(outputProps, overrideFunc(resourceValue)...)
+		sort.Strings(outputProps)
+		return outputProps, true
+	}
+	switch typedResource := resourceValue.(type) {
+	case gocf.APIGatewayRestAPI:
+		outputProps = append(outputProps, "RootResourceId")
 	case gocf.IAMRole:
-		// NOP
+		outputProps = append(outputProps, "Arn")
+	case gocf.CloudFormationStack:
+		// The nested stack's Outputs aren't known. Use NestedStack
+		// to publish them.
+	case gocf.CertificateManagerCertificate,
+		gocf.ECSTaskDefinition,
+		gocf.GlueCrawler,
+		gocf.GlueDatabase,
+		gocf.GlueJob,
+		gocf.LambdaAlias,
+		gocf.LambdaEventSourceMapping,
+		gocf.Route53RecordSet,
+		gocf.SNSSubscription:
+		// These types don't expose any Fn::GetAtt attributes. The Ref
+		// value is published by resourceComputedOutputs.
+	case gocf.CloudFrontDistribution:
+		outputProps = append(outputProps, "DomainName")
+	case gocf.CloudWatchAlarm:
+		outputProps = append(outputProps, "Arn")
+	case gocf.CognitoIDentityPool:
+		outputProps = append(outputProps, "Name")
+	case gocf.CognitoUserPool:
+		outputProps = append(outputProps, "Arn", "ProviderName", "ProviderURL")
+	case gocf.DAXCluster:
+		outputProps = append(outputProps, "Arn", "ClusterDiscoveryEndpoint")
 	case gocf.DynamoDBTable:
+		outputProps = append(outputProps, "Arn")
 		if typedResource.StreamSpecification != nil {
 			outputProps = append(outputProps, "StreamArn")
 		}
+	case gocf.EC2Instance:
+		// PublicDnsName resolves to an empty string for
+		// instances without a public IP address
+		outputProps = append(outputProps, "PrivateIp", "PrivateDnsName", "PublicDnsName")
+	case gocf.EC2SecurityGroup:
+		outputProps = append(outputProps, "GroupId", "VpcId")
+	case gocf.ECRRepository:
+		outputProps = append(outputProps, "Arn", "RepositoryUri")
+	case gocf.ECSService:
+		outputProps = append(outputProps, "Name")
+	case gocf.EFSFileSystem:
+		outputProps = append(outputProps, "Arn")
+	case gocf.ElastiCacheCacheCluster:
+		// The endpoint attribute names depend on the engine
+		switch elastiCacheEngine(typedResource) {
+		case "redis":
+			outputProps = append(outputProps, "RedisEndpoint.Address", "RedisEndpoint.Port")
+		case "memcached":
+			outputProps = append(outputProps, "ConfigurationEndpoint.Address", "ConfigurationEndpoint.Port")
+		}
+	case gocf.ElastiCacheReplicationGroup:
+		outputProps = append(outputProps, "PrimaryEndPoint.Address", "PrimaryEndPoint.Port")
+	case gocf.ElasticsearchDomain:
+		outputProps = append(outputProps, "DomainArn", "DomainEndpoint")
+	case gocf.EventsRule:
+		outputProps = append(outputProps, "Arn")
+	case gocf.KinesisFirehoseDeliveryStream:
+		outputProps = append(outputProps, "Arn")
 	case gocf.KinesisStream:
 		outputProps = append(outputProps, "Arn")
-	case gocf.Route53RecordSet:
-		// TODO
+	case gocf.LambdaFunction:
+		outputProps = append(outputProps, "Arn")
+	case gocf.LambdaVersion:
+		outputProps = append(outputProps, "Version")
+	case gocf.RDSDBCluster:
+		outputProps = append(outputProps, "Endpoint.Address", "Endpoint.Port", "ReadEndpoint.Address")
+	case gocf.RDSDBInstance:
+		outputProps = append(outputProps, "Endpoint.Address", "Endpoint.Port")
+	case gocf.Route53HostedZone:
+		// The NameServers attribute is a list, which can't be included
+		// in the discovery data string
 	case gocf.S3Bucket:
-		outputProps = append(outputProps, "DomainName", "WebsiteURL")
+		outputProps = append(outputProps, "Arn", "DomainName", "RegionalDomainName")
+		// WebsiteURL is only available for website buckets
+		if typedResource.WebsiteConfiguration != nil {
+			outputProps = append(outputProps, "WebsiteURL")
+		}
 	case gocf.SNSTopic:
 		outputProps = append(outputProps, "TopicName")
 	case gocf.SQSQueue:
 		outputProps = append(outputProps, "Arn", "QueueName")
+	case gocf.StepFunctionsStateMachine:
+		outputProps = append(outputProps, "Name")
+	case gocf.SSMParameter:
+		outputProps = append(outputProps, "Type")
 	default:
+		if discoverable, discoverableOk := resource.(DiscoverableResource); discoverableOk {
+			outputProps = append(outputProps, discoverable.DiscoverableOutputs()...)
+			break
+		}
+		if discoverable, discoverableOk := typedResource.(DiscoverableResource); discoverableOk {
+			outputProps = append(outputProps, discoverable.DiscoverableOutputs()...)
+			break
+		}
+		typeOutputs, typeOutputsOk := resourceTypeOutputs(typedResource.CfnResourceType())
+		if typeOutputsOk {
+			outputProps = append(outputProps, typeOutputs...)
+			break
+		}
+		outputFunc, outputFuncOk := registeredResourceOutputs.lookup(typedResource.CfnResourceType(), false)
+		if outputFuncOk {
+			outputProps = append(outputProps, outputFunc(resourceValue)...)
+			break
+		}
+		return nil, false
+	}
+	// Sort the names so that the discovery information is stable
+	sort.Strings(outputProps)
+	return outputProps, true
+}
+
+// elastiCacheEngine returns the lowercase Engine name of the cluster, or
+// the empty string if the Engine isn't a literal value
+func elastiCacheEngine(cluster gocf.ElastiCacheCacheCluster) string {
+	if cluster.Engine == nil || cluster.Engine.Func != nil {
+		return ""
+	}
+	return strings.ToLower(cluster.Engine.Literal)
+}
+
+// resourceOutputs is responsible for returning the conditional
+// set of CloudFormation outputs for a given resource type. If strict
+// is true, resource types that don't publish discovery information
+// are reported as an error rather than a warning. The attribute
+// names are returned in sorted order.
+func resourceOutputs(resourceName string,
+	resource gocf.ResourceProperties,
+	strict bool,
+	logger *logrus.Logger) ([]string, error) {
+
+	strict = strict || StrictDiscovery
+	resourceValue := resourcePropertiesValue(resource)
+	if resourceValue == nil {
+		if strict {
+			return nil, fmt.Errorf("Discovery information unavailable for resource without properties: %s",
+				resourceName)
+		}
 		logger.WithFields(logrus.Fields{
-			"ResourceType": fmt.Sprintf("%T", typedResource),
-		}).Warn("Discovery information for dependency not yet implemented")
+			"ResourceName": resourceName,
+		}).Warn("Discovery information unavailable for resource without properties")
+		return []string{}, nil
+	}
+	outputProps, outputPropsOk := resourceOutputsLookup(resource)
+	if outputPropsOk {
+		if cacheCluster, cacheClusterOk := resourceValue.(gocf.ElastiCacheCacheCluster); cacheClusterOk &&
+			elastiCacheEngine(cacheCluster) == "" {
+			if strict {
+				return nil, fmt.Errorf("ElastiCache cluster %s endpoint discovery requires a literal Engine value",
+					resourceName)
+			}
+			logger.WithFields(logrus.Fields{
+				"ResourceName": resourceName,
+			}).Warn("ElastiCache cluster endpoint discovery requires a literal Engine value")
+		}
+		return outputProps, nil
+	}
+	if strict {
+		return nil, fmt.Errorf("Discovery information for dependency %s (%T) not yet implemented",
+			resourceName,
+			resourceValue)
+	}
+	if UnsupportedResourceHandler != nil {
+		UnsupportedResourceHandler(resourceName, resourceValue.CfnResourceType())
+		return []string{}, nil
+	}
+	logger.WithFields(logrus.Fields{
+		"ResourceType": fmt.Sprintf("%T", resourceValue),
+	}).Warn("Discovery information for dependency not yet implemented")
+	return []string{}, nil
+}
+
+// UndiscoverableResources returns the logical name and CloudFormation type
+// of every resource in the template whose type doesn't publish sparta.Discover
+// information. These types can be supported via RegisterResourceOutputs.
+// The template isn't modified.
+func UndiscoverableResources(cfTemplate *gocf.Template) map[string]string {
+	unsupportedResources := make(map[string]string)
+	for eachName, eachResource := range cfTemplate.Resources {
+		resourceValue := resourcePropertiesValue(eachResource.Properties)
+		if resourceValue == nil {
+			continue
+		}
+		_, outputsOk := resourceOutputsLookup(resourceValue)
+		if !outputsOk {
+			unsupportedResources[eachName] = resourceValue.CfnResourceType()
+		}
+	}
+	return unsupportedResources
+}
+
+// DiscoveryAttribute is a single Fn::GetAtt attribute that is published
+// as sparta.Discover information
+type DiscoveryAttribute struct {
+	// The logical resource name
+	ResourceName string
+	// The Fn::GetAtt attribute name
+	Attribute string
+}
+
+// DiscoveryAttributes returns every Fn::GetAtt attribute that is published
+// as sparta.Discover information for the template's resources, ordered by
+// logical name and attribute. It's intended to scope IAM policies
+// to the values that handlers can discover. Resource types that don't
+// publish discovery information are skipped (see UndiscoverableResources).
+// The template isn't modified.
+func DiscoveryAttributes(cfTemplate *gocf.Template) []DiscoveryAttribute {
+	resourceNames := make([]string, 0, len(cfTemplate.Resources))
+	for eachName := range cfTemplate.Resources {
+		resourceNames = append(resourceNames, eachName)
+	}
+	sort.Strings(resourceNames)
+
+	attributes := make([]DiscoveryAttribute, 0)
+	for _, eachName := range resourceNames {
+		resourceValue := resourcePropertiesValue(cfTemplate.Resources[eachName].Properties)
+		if resourceValue == nil {
+			continue
+		}
+		outputs, outputsOk := resourceOutputsLookup(resourceValue)
+		if !outputsOk {
+			continue
+		}
+		for _, eachOutput := range outputs {
+			attributes = append(attributes, DiscoveryAttribute{
+				ResourceName: eachName,
+				Attribute:    eachOutput,
+			})
+		}
+	}
+	return attributes
+}
+
+// resourceComputedOutputs returns the discovery properties whose values
+// aren't a single Fn::GetAtt attribute. The map values are the inline
+// JSON expressions that are resolved by CloudFormation. Some resources
+// only expose commonly used values via Ref, while others (eg, DynamoDB
+// GSI ARNs) must be assembled from an attribute.
+func resourceComputedOutputs(resourceName string,
+	resource gocf.ResourceProperties) map[string]string {
+
+	computedOutputs := make(map[string]string)
+	refExpr := fmt.Sprintf(`{ "Ref" : "%s" }`, resourceName)
+
+	switch typedResource := resourcePropertiesValue(resource).(type) {
+	case gocf.APIGatewayRestAPI:
+		computedOutputs["RestApiId"] = refExpr
+	case gocf.CloudFormationStack, NestedStack:
+		computedOutputs["StackId"] = refExpr
+	case gocf.CertificateManagerCertificate:
+		computedOutputs["Arn"] = refExpr
+	case gocf.CloudFrontDistribution:
+		computedOutputs["DistributionId"] = refExpr
+	case gocf.CloudWatchAlarm:
+		computedOutputs["AlarmName"] = refExpr
+	case gocf.CognitoIDentityPool:
+		computedOutputs["IdentityPoolId"] = refExpr
+	case gocf.CognitoUserPool:
+		computedOutputs["UserPoolId"] = refExpr
+	case gocf.DynamoDBTable:
+		if typedResource.StreamSpecification != nil &&
+			typedResource.StreamSpecification.StreamViewType != nil &&
+			typedResource.StreamSpecification.StreamViewType.Func == nil {
+			computedOutputs["StreamViewType"] = escapeDiscoveryLiteral(typedResource.StreamSpecification.StreamViewType.Literal)
+		}
+		if typedResource.GlobalSecondaryIndexes == nil {
+			break
+		}
+		for _, eachIndex := range *typedResource.GlobalSecondaryIndexes {
+			// Only literal names can be used for the property key
+			if eachIndex.IndexName == nil || eachIndex.IndexName.Func != nil {
+				continue
+			}
+			indexName := eachIndex.IndexName.Literal
+			propName := fmt.Sprintf("GlobalSecondaryIndex.%s.Arn", indexName)
+			computedOutputs[propName] = fmt.Sprintf(`{ "Fn::GetAtt" : [ "%s", "Arn" ] }/index/%s`,
+				resourceName,
+				indexName)
+		}
+	case gocf.EC2Instance:
+		computedOutputs["InstanceId"] = refExpr
+	case gocf.EFSFileSystem:
+		computedOutputs["FileSystemId"] = refExpr
+	case gocf.ECSService:
+		computedOutputs["ServiceArn"] = refExpr
+	case gocf.ECSTaskDefinition:
+		computedOutputs["TaskDefinitionArn"] = refExpr
+	case gocf.GlueCrawler:
+		computedOutputs["CrawlerName"] = refExpr
+	case gocf.GlueDatabase:
+		computedOutputs["DatabaseName"] = refExpr
+	case gocf.GlueJob:
+		computedOutputs["JobName"] = refExpr
+	case gocf.KinesisStream:
+		computedOutputs["Name"] = refExpr
+	case gocf.LambdaEventSourceMapping:
+		computedOutputs["EventSourceMappingId"] = refExpr
+	case gocf.LambdaAlias:
+		computedOutputs["AliasArn"] = refExpr
+	case gocf.Route53HostedZone:
+		computedOutputs["HostedZoneId"] = refExpr
+	case gocf.Route53RecordSet:
+		computedOutputs["Name"] = refExpr
+		// Records identify their zone by either id or name. Only
+		// literal values are published.
+		if typedResource.HostedZoneID != nil &&
+			typedResource.HostedZoneID.Func == nil &&
+			typedResource.HostedZoneID.Literal != "" {
+			computedOutputs["HostedZoneId"] = escapeDiscoveryLiteral(typedResource.HostedZoneID.Literal)
+		}
+		if typedResource.HostedZoneName != nil &&
+			typedResource.HostedZoneName.Func == nil &&
+			typedResource.HostedZoneName.Literal != "" {
+			computedOutputs["HostedZoneName"] = escapeDiscoveryLiteral(typedResource.HostedZoneName.Literal)
+		}
+	case gocf.SNSSubscription:
+		computedOutputs["Arn"] = refExpr
+	case gocf.SNSTopic:
+		computedOutputs["Arn"] = refExpr
+		// FIFO topic names must end with .fifo. Publishers need
+		// to know this to include a message group id.
+		if typedResource.TopicName != nil &&
+			typedResource.TopicName.Func == nil &&
+			strings.HasSuffix(typedResource.TopicName.Literal, ".fifo") {
+			computedOutputs["FifoTopic"] = "true"
+		}
+		// The display name is used as the SMS sender id
+		if typedResource.DisplayName != nil &&
+			typedResource.DisplayName.Func == nil &&
+			typedResource.DisplayName.Literal != "" {
+			computedOutputs["DisplayName"] = escapeDiscoveryLiteral(typedResource.DisplayName.Literal)
+		}
+	case gocf.SQSQueue:
+		computedOutputs["QueueUrl"] = refExpr
+	case gocf.SSMParameter:
+		computedOutputs["Name"] = refExpr
+	case gocf.StepFunctionsStateMachine:
+		computedOutputs["Arn"] = refExpr
+	case nil:
+		// NOP
+	default:
+		switch typedResource.CfnResourceType() {
+		case "AWS::ApiGatewayV2::Api":
+			computedOutputs["ApiId"] = refExpr
+		case "AWS::AppConfig::Application":
+			computedOutputs["ApplicationId"] = refExpr
+		case "AWS::AppConfig::ConfigurationProfile":
+			computedOutputs["ConfigurationProfileId"] = refExpr
+		case "AWS::AppConfig::Environment":
+			computedOutputs["EnvironmentId"] = refExpr
+		case "AWS::CloudWatch::CompositeAlarm":
+			computedOutputs["AlarmName"] = refExpr
+		case "AWS::KinesisAnalyticsV2::Application":
+			computedOutputs["ApplicationName"] = refExpr
+			computedOutputs["Arn"] = fmt.Sprintf(`arn:{ "Ref" : "AWS::Partition" }:kinesisanalytics:{ "Ref" : "AWS::Region" }:{ "Ref" : "AWS::AccountId" }:application/%s`,
+				refExpr)
+		case "AWS::Lambda::LayerVersion":
+			computedOutputs["LayerVersionArn"] = refExpr
+		case "AWS::SecretsManager::Secret":
+			computedOutputs["Arn"] = refExpr
+		case "AWS::Timestream::Database":
+			computedOutputs["DatabaseName"] = refExpr
+		}
+	}
+	return computedOutputs
+}
+
+var registeredCustomResourceProviders struct {
+	sync.RWMutex
+	providers []gocf.CustomResourceProvider
+}
+
+// RegisterCustomResourceProvider registers a provider that returns the
+// ResourceProperties for custom CloudFormation resource types. Unlike
+// gocf.RegisterCustomResourceProvider, it's safe to call concurrently with
+// other registrations and with resource lookups. Providers return nil
+// for unsupported resource types.
+func RegisterCustomResourceProvider(provider gocf.CustomResourceProvider) {
+	registeredCustomResourceProviders.Lock()
+	defer registeredCustomResourceProviders.Unlock()
+	registeredCustomResourceProviders.providers = append(registeredCustomResourceProviders.providers,
+		provider)
+}
+
+// registeredCustomResource returns the ResourceProperties from the first
+// registered provider that supports the resource type, or nil
+func registeredCustomResource(resourceType string) gocf.ResourceProperties {
+	registeredCustomResourceProviders.RLock()
+	defer registeredCustomResourceProviders.RUnlock()
+	for _, eachProvider := range registeredCustomResourceProviders.providers {
+		if resProps := eachProvider(resourceType); resProps != nil {
+			return resProps
+		}
 	}
-	return outputProps, nil
+	return nil
 }
 
 func newCloudFormationResource(resourceType string, logger *logrus.Logger) (gocf.ResourceProperties, error) {
-	resProps := gocf.NewResourceByType(resourceType)
+	resProps := registeredCustomResource(resourceType)
+	if nil == resProps {
+		resProps = gocf.NewResourceByType(resourceType)
+	}
 	if nil == resProps {
-		logger.WithFields(logrus.Fields{
-			"Type": resourceType,
-		}).Fatal("Failed to create CloudFormation CustomResource!")
 		return nil, fmt.Errorf("Unsupported CustomResourceType: %s", resourceType)
 	}
 	return resProps, nil
 }
 
-type discoveryDataTemplate struct {
-	ResourceID         string
-	ResourceType       string
-	ResourceProperties string
+// discoveryOptions controls how discovery information is generated
+// for a dependency. A nil value uses the default options.
+type discoveryOptions struct {
+	// Return an error, rather than log a warning, for dependencies
+	// whose resource type doesn't publish discovery information
+	strict bool
+	// Literal properties that are included in the discovery information
+	staticProperties map[string]string
+	// If non-nil, the CloudFormation resource types that may
+	// publish discovery information
+	allowedResourceTypes map[string]bool
 }
 
-var discoveryDataForResourceDependency = `
-	{
-		"ResourceID" : "<< .ResourceID >>",
-		"ResourceRef" : "{"Ref":"<< .ResourceID >>"}",
-		"ResourceType" : "<< .ResourceType >>",
-		"Properties" : {
-			<< .ResourceProperties >>
-		}
+// checkAllowedResourceType returns an error if the options restrict
+// discovery information to a set of resource types that doesn't
+// include resourceType.
+func (options *discoveryOptions) checkAllowedResourceType(logicalResourceName string,
+	resourceType string) error {
+	if options.allowedResourceTypes == nil ||
+		options.allowedResourceTypes[resourceType] {
+		return nil
 	}
-`
+	return fmt.Errorf("Discovery information is not allowed for resource %s (type: %s)",
+		logicalResourceName,
+		resourceType)
+}
+
+// escapeDiscoveryLiteral returns the JSON string escaped form of value,
+// without the enclosing quotes, so that it can be embedded in the
+// discovery data. Braces are also escaped so that the literal isn't
+// treated as either a text/template action or an inline
+// CloudFormation expression.
+func escapeDiscoveryLiteral(value string) string {
+	quotedValue, _ := json.Marshal(value)
+	escapedValue := string(quotedValue[1 : len(quotedValue)-1])
+	escapedValue = strings.Replace(escapedValue, "{", `\u007b`, -1)
+	return strings.Replace(escapedValue, "}", `\u007d`, -1)
+}
+
+// The text/template delimiters for the discovery templates. The default
+// {{ }} delimiters would conflict with the inline JSON expressions. The
+// delimiters only apply to the template text, so template data values
+// that include them (eg, resource names) are rendered as-is.
+const (
+	discoveryTemplateLeftDelim  = "<<"
+	discoveryTemplateRightDelim = ">>"
+)
 
-func discoveryResourceInfoForDependency(cfTemplate *gocf.Template,
+// discoveryDependency is the discovery information for a dependency,
+// before it's rendered into the discovery data
+type discoveryDependency struct {
+	resourceType string
+	// The property names, with the Fn::GetAtt attributes first and the
+	// remaining properties in sorted order
+	propertyNames []string
+	// The property values are escaped JSON string contents that may
+	// include inline CloudFormation expressions
+	properties map[string]string
+}
+
+// newDiscoveryDependency returns the discovery information for the
+// dependency. A nil value is returned if the dependency isn't defined
+// in the template. A nil options value uses the default options.
+func newDiscoveryDependency(cfTemplate *gocf.Template,
 	logicalResourceName string,
-	logger *logrus.Logger) ([]byte, error) {
+	options *discoveryOptions,
+	logger *logrus.Logger) (*discoveryDependency, error) {
 
+	if logicalResourceName == "" {
+		return nil, fmt.Errorf("Discovery information requires a non-empty logical resource name")
+	}
+	if options == nil {
+		options = &discoveryOptions{}
+	}
 	item, ok := cfTemplate.Resources[logicalResourceName]
 	if !ok {
 		return nil, nil
 	}
+	if resourcePropertiesValue(item.Properties) == nil {
+		return nil, fmt.Errorf("Resource %s does not define Properties", logicalResourceName)
+	}
+	resourceType := item.Properties.CfnResourceType()
+	allowedErr := options.checkAllowedResourceType(logicalResourceName, resourceType)
+	if allowedErr != nil {
+		return nil, allowedErr
+	}
 	resourceOutputs, resourceOutputsErr := resourceOutputs(logicalResourceName,
 		item.Properties,
+		options.strict,
 		logger)
 	if resourceOutputsErr != nil {
 		return nil, resourceOutputsErr
 	}
-	// Template data
-	templateData := &discoveryDataTemplate{
-		ResourceID:   logicalResourceName,
-		ResourceType: item.Properties.CfnResourceType(),
-	}
-	quotedAttrs := make([]string, 0)
+	properties := make(map[string]string)
+	propertyNames := make([]string, 0)
+	getAttNames := make(map[string]bool)
 	for _, eachOutput := range resourceOutputs {
-		quotedAttrs = append(quotedAttrs,
-			fmt.Sprintf(`"%s" :"{ "Fn::GetAtt" : [ "%s", "%s" ] }"`,
-				eachOutput,
+		properties[eachOutput] = fmt.Sprintf(`{ "Fn::GetAtt" : [ "%s", "%s" ] }`,
+			logicalResourceName,
+			eachOutput)
+		propertyNames = append(propertyNames, eachOutput)
+		getAttNames[eachOutput] = true
+	}
+	computedOutputs := resourceComputedOutputs(logicalResourceName, item.Properties)
+	for eachKey, eachValue := range computedOutputs {
+		properties[eachKey] = eachValue
+	}
+	for eachKey, eachValue := range options.staticProperties {
+		properties[escapeDiscoveryLiteral(eachKey)] = escapeDiscoveryLiteral(eachValue)
+	}
+	registeredDiscoveryTransforms.RLock()
+	transforms := registeredDiscoveryTransforms.transforms
+	registeredDiscoveryTransforms.RUnlock()
+	for _, eachTransform := range transforms {
+		transformProperties := make(map[string]string, len(properties))
+		for eachKey, eachValue := range properties {
+			transformProperties[eachKey] = eachValue
+		}
+		for eachKey, eachValue := range eachTransform(logicalResourceName,
+			resourceType,
+			transformProperties) {
+			propertyErr := validateDiscoveryProperty(logicalResourceName, eachKey, eachValue)
+			if propertyErr != nil {
+				return nil, propertyErr
+			}
+			properties[eachKey] = eachValue
+		}
+	}
+
+	additionalNames := make([]string, 0)
+	for eachKey := range properties {
+		if !getAttNames[eachKey] {
+			additionalNames = append(additionalNames, eachKey)
+		}
+	}
+	sort.Strings(additionalNames)
+	return &discoveryDependency{
+		resourceType:  resourceType,
+		propertyNames: append(propertyNames, additionalNames...),
+		properties:    properties,
+	}, nil
+}
+
+// discoveryResourceExpr is the typed discovery information for a
+// dependency. The ResourceRef and Properties values are CloudFormation
+// expressions that are resolved when the stack is provisioned.
+type discoveryResourceExpr struct {
+	ResourceID   string
+	ResourceRef  *gocf.StringExpr
+	ResourceType string
+	// Each value is a *gocf.StringExpr
+	Properties map[string]interface{}
+	// The Properties names, in the order they're published
+	propertyNames []string
+}
+
+// discoveryPropertyExpr returns the expression for a JSON string escaped
+// discovery property value, which may include inline expressions. The
+// literal parts of the expression are unescaped.
+func discoveryPropertyExpr(logicalResourceName string,
+	escapedValue string) (*gocf.StringExpr, error) {
+	valueExpr, valueExprErr := spartaCF.ConvertToTemplateExpression(strings.NewReader(escapedValue), nil)
+	if valueExprErr != nil {
+		return nil, fmt.Errorf("Invalid discovery property value for resource %s: %s",
+			logicalResourceName,
+			valueExprErr)
+	}
+	joinFunc, joinFuncOk := valueExpr.Func.(gocf.JoinFunc)
+	if !joinFuncOk {
+		return nil, fmt.Errorf("Invalid discovery property expression for resource %s",
+			logicalResourceName)
+	}
+	joinItems := make([]gocf.Stringable, 0, len(joinFunc.Items.Literal))
+	for _, eachItem := range joinFunc.Items.Literal {
+		if eachItem.Func != nil {
+			joinItems = append(joinItems, eachItem)
+			continue
+		}
+		literalValue, literalValueErr := unescapedDiscoveryLiteral(eachItem.Literal)
+		if literalValueErr != nil {
+			return nil, fmt.Errorf("Invalid discovery property value for resource %s: %s",
+				logicalResourceName,
+				literalValueErr)
+		}
+		joinItems = append(joinItems, gocf.String(literalValue))
+	}
+	return gocf.Join("", joinItems...), nil
+}
+
+// unescapedDiscoveryLiteral returns the value of the JSON string escaped
+// literal, which is the inverse of escapeDiscoveryLiteral
+func unescapedDiscoveryLiteral(escapedValue string) (string, error) {
+	var literalValue string
+	unmarshalErr := json.Unmarshal([]byte(fmt.Sprintf(`"%s"`, escapedValue)), &literalValue)
+	return literalValue, unmarshalErr
+}
+
+// discoveryPropertyText returns the JSON string escaped text for the
+// discovery expression, with each function written as an inline
+// expression
+func discoveryPropertyText(valueExpr *gocf.StringExpr) (string, error) {
+	if valueExpr.Func == nil {
+		return escapeDiscoveryLiteral(valueExpr.Literal), nil
+	}
+	joinFunc, joinFuncOk := valueExpr.Func.(gocf.JoinFunc)
+	if !joinFuncOk {
+		inlineExpr, inlineExprErr := json.Marshal(valueExpr)
+		return string(inlineExpr), inlineExprErr
+	}
+	var propertyText bytes.Buffer
+	for _, eachItem := range joinFunc.Items.Literal {
+		itemText, itemTextErr := discoveryPropertyText(eachItem)
+		if itemTextErr != nil {
+			return "", itemTextErr
+		}
+		propertyText.WriteString(itemText)
+	}
+	return propertyText.String(), nil
+}
+
+// discoveryResourceExprForDependency returns the typed discovery
+// information for the dependency. A nil value is returned if the
+// dependency isn't defined in the template. A nil options value uses the
+// default options.
+func discoveryResourceExprForDependency(cfTemplate *gocf.Template,
+	logicalResourceName string,
+	options *discoveryOptions,
+	logger *logrus.Logger) (*discoveryResourceExpr, error) {
+
+	dependency, dependencyErr := newDiscoveryDependency(cfTemplate,
+		logicalResourceName,
+		options,
+		logger)
+	if dependency == nil || dependencyErr != nil {
+		return nil, dependencyErr
+	}
+	resourceExpr := &discoveryResourceExpr{
+		ResourceID:    logicalResourceName,
+		ResourceRef:   gocf.Ref(logicalResourceName).String(),
+		ResourceType:  dependency.resourceType,
+		Properties:    make(map[string]interface{}),
+		propertyNames: make([]string, 0, len(dependency.propertyNames)),
+	}
+	for _, eachName := range dependency.propertyNames {
+		propertyName, propertyNameErr := unescapedDiscoveryLiteral(eachName)
+		if propertyNameErr != nil {
+			return nil, fmt.Errorf("Invalid discovery property name %s for resource %s: %s",
+				eachName,
 				logicalResourceName,
-				eachOutput))
-	}
-	templateData.ResourceProperties = strings.Join(quotedAttrs, ",")
-
-	// Create the data that can be stuffed into Environment
-	discoveryTemplate, discoveryTemplateErr := template.New("discoveryResourceData").
-		Delims("<<", ">>").
-		Parse(discoveryDataForResourceDependency)
-	if nil != discoveryTemplateErr {
-		return nil, discoveryTemplateErr
-	}
-
-	var templateResults bytes.Buffer
-	evalResultErr := discoveryTemplate.Execute(&templateResults, templateData)
-	return templateResults.Bytes(), evalResultErr
-
-	// outputs := make(map[string]interface{})
-	// outputs["ResourceID"] = logicalResourceName
-	// outputs["ResourceType"] = item.Properties.CfnResourceType()
-	// if len(resourceOutputs) != 0 {
-	// 	properties := make(map[string]interface{})
-	// 	for _, eachAttr := range resourceOutputs {
-	// 		properties[eachAttr] = gocf.GetAtt(logicalResourceName, eachAttr)
-	// 	}
-	// 	if len(properties) != 0 {
-	// 		outputs["Properties"] = properties
-	// 	}
-	// }
-	// if len(outputs) != 0 {
-	// 	logger.WithFields(logrus.Fields{
-	// 		"ResourceName": logicalResourceName,
-	// 		"Outputs":      outputs,
-	// 	}).Debug("Resource Outputs")
-	// }
-	// return outputs, nil
+				propertyNameErr)
+		}
+		propertyExpr, propertyExprErr := discoveryPropertyExpr(logicalResourceName,
+			dependency.properties[eachName])
+		if propertyExprErr != nil {
+			return nil, propertyExprErr
+		}
+		resourceExpr.Properties[propertyName] = propertyExpr
+		resourceExpr.propertyNames = append(resourceExpr.propertyNames, propertyName)
+	}
+	return resourceExpr, nil
+}
+
+// discoveryResourceJSONForDependency returns the discovery information for
+// the dependency, rendered from the discoveryResourceExprForDependency
+// value. Only the ResourceID and ResourceType values are escaped by
+// encoding/json. The ResourceRef and Properties values include inline
+// expressions, so they're written as text by discoveryPropertyText and
+// substituted for placeholder strings in the marshaled object. The
+// Properties entries are written in propertyNames order, and the result
+// is validated before it's returned. The ResourceRef expression is
+// converted to a Ref function in the Fn::Join that's assigned to the
+// function's environment, so it resolves to the physical resource id when
+// the stack is deployed.
+func discoveryResourceJSONForDependency(cfTemplate *gocf.Template,
+	logicalResourceName string,
+	options *discoveryOptions,
+	logger *logrus.Logger) ([]byte, error) {
+
+	resourceExpr, resourceExprErr := discoveryResourceExprForDependency(cfTemplate,
+		logicalResourceName,
+		options,
+		logger)
+	if resourceExpr == nil || resourceExprErr != nil {
+		return nil, resourceExprErr
+	}
+	propertyEntries := make([]string, 0, len(resourceExpr.propertyNames))
+	for _, eachName := range resourceExpr.propertyNames {
+		propertyExpr, _ := resourceExpr.Properties[eachName].(*gocf.StringExpr)
+		if propertyExpr == nil {
+			return nil, fmt.Errorf("Discovery property %s for resource %s must be a *gocf.StringExpr",
+				eachName,
+				logicalResourceName)
+		}
+		propertyText, propertyTextErr := discoveryPropertyText(propertyExpr)
+		if propertyTextErr != nil {
+			return nil, propertyTextErr
+		}
+		propertyEntries = append(propertyEntries,
+			fmt.Sprintf(`"%s":"%s"`, escapeDiscoveryLiteral(eachName), propertyText))
+	}
+	refText, refTextErr := discoveryPropertyText(resourceExpr.ResourceRef)
+	if refTextErr != nil {
+		return nil, refTextErr
+	}
+	expressions := map[string]string{
+		"__SPARTA_DISCOVERY_REF__":        fmt.Sprintf(`"%s"`, refText),
+		"__SPARTA_DISCOVERY_PROPERTIES__": fmt.Sprintf("{%s}", strings.Join(propertyEntries, ",")),
+	}
+	discoveryObject := struct {
+		ResourceID   string
+		ResourceRef  string
+		ResourceType string
+		Properties   string
+	}{
+		ResourceID:   resourceExpr.ResourceID,
+		ResourceRef:  "__SPARTA_DISCOVERY_REF__",
+		ResourceType: resourceExpr.ResourceType,
+		Properties:   "__SPARTA_DISCOVERY_PROPERTIES__",
+	}
+	discoveryJSON, discoveryJSONErr := json.Marshal(discoveryObject)
+	if discoveryJSONErr != nil {
+		return nil, discoveryJSONErr
+	}
+	discoveryText := string(discoveryJSON)
+	for eachPlaceholder, eachExpression := range expressions {
+		discoveryText = strings.Replace(discoveryText,
+			fmt.Sprintf(`"%s"`, eachPlaceholder),
+			eachExpression,
+			1)
+	}
+	validateErr := validateDiscoveryData(logicalResourceName, []byte(discoveryText))
+	if validateErr != nil {
+		return nil, validateErr
+	}
+	return []byte(discoveryText), nil
+}
+
+// discoveryInfoForDependencies returns a single JSON object with the
+// discovery information for each dependency, keyed by logical resource
+// name. Names that aren't defined in the template are skipped.
+func discoveryInfoForDependencies(cfTemplate *gocf.Template,
+	dependencyNames []string,
+	options *discoveryOptions,
+	logger *logrus.Logger) ([]byte, error) {
+
+	sortedNames := make([]string, len(dependencyNames))
+	copy(sortedNames, dependencyNames)
+	sort.Strings(sortedNames)
+
+	dependencyEntries := make([]string, 0)
+	for eachIndex, eachName := range sortedNames {
+		if eachIndex != 0 && sortedNames[eachIndex-1] == eachName {
+			continue
+		}
+		discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(cfTemplate,
+			eachName,
+			options,
+			logger)
+		if discoveryDataErr != nil {
+			return nil, discoveryDataErr
+		}
+		if discoveryData == nil {
+			continue
+		}
+		quotedName, quotedNameErr := json.Marshal(eachName)
+		if quotedNameErr != nil {
+			return nil, quotedNameErr
+		}
+		dependencyEntries = append(dependencyEntries,
+			fmt.Sprintf("%s:%s", quotedName, discoveryData))
+	}
+	return []byte(fmt.Sprintf("{%s}", strings.Join(dependencyEntries, ","))), nil
+}
+
+// validateDiscoveryData ensures that the discovery data will be well formed
+// JSON after CloudFormation resolves the inline expressions. Each
+// expression is replaced by a placeholder string before parsing.
+func validateDiscoveryData(logicalResourceName string, discoveryData []byte) error {
+	_, resolvedDataErr := resolvedDiscoveryResource(logicalResourceName, discoveryData)
+	return resolvedDataErr
+}
+
+// validateDiscoveryProperty returns an error if the discovery property
+// name or value isn't a JSON string escaped literal, which may include
+// inline expressions
+func validateDiscoveryProperty(logicalResourceName string,
+	propertyName string,
+	propertyValue string) error {
+	propertyData := fmt.Sprintf(`{"Properties":{"%s":"%s"}}`, propertyName, propertyValue)
+	_, resolvedErr := resolvedDiscoveryResource(logicalResourceName, []byte(propertyData))
+	if resolvedErr != nil {
+		return fmt.Errorf("Discovery property %s for resource %s must be JSON string escaped: %s",
+			propertyName,
+			logicalResourceName,
+			resolvedErr)
+	}
+	return nil
+}
+
+// validateDiscoveryInfo returns an error if the combined discovery
+// information for a function doesn't produce a valid DiscoveryInfo once
+// each inline expression is resolved
+func validateDiscoveryInfo(logicalResourceName string, discoveryData []byte) error {
+	var parsedInfo DiscoveryInfo
+	return resolveDiscoveryJSON(logicalResourceName, discoveryData, &parsedInfo)
+}
+
+// resolvedDiscoveryResource returns the DiscoveryResource that results from
+// replacing each inline expression in the discovery data with a
+// placeholder string
+func resolvedDiscoveryResource(logicalResourceName string,
+	discoveryData []byte) (*DiscoveryResource, error) {
+	var parsedData DiscoveryResource
+	resolveErr := resolveDiscoveryJSON(logicalResourceName, discoveryData, &parsedData)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	return &parsedData, nil
 }
+
+// resolveDiscoveryJSON replaces each inline expression in the discovery
+// data with a placeholder string and unmarshals the result into value
+func resolveDiscoveryJSON(logicalResourceName string,
+	discoveryData []byte,
+	value interface{}) error {
+	joinExpr, joinExprErr := spartaCF.ConvertToTemplateExpression(bytes.NewReader(discoveryData), nil)
+	if joinExprErr != nil {
+		return fmt.Errorf("Invalid discovery data for resource %s: %s",
+			logicalResourceName,
+			joinExprErr)
+	}
+	var resolvedData bytes.Buffer
+	joinFunc, joinFuncOk := joinExpr.Func.(gocf.JoinFunc)
+	if !joinFuncOk {
+		return fmt.Errorf("Invalid discovery data expression for resource %s", logicalResourceName)
+	}
+	for _, eachItem := range joinFunc.Items.Literal {
+		if eachItem.Func != nil {
+			resolvedData.WriteString("resolved")
+		} else {
+			resolvedData.WriteString(eachItem.Literal)
+		}
+	}
+	unmarshalErr := json.Unmarshal(resolvedData.Bytes(), value)
+	if unmarshalErr != nil {
+		return fmt.Errorf("Invalid discovery data JSON for resource %s: %s",
+			logicalResourceName,
+			unmarshalErr)
+	}
+	return nil
+}
+
+// DiscoveryValidationResult describes a resource that doesn't produce
+// usable sparta.Discover information
+type DiscoveryValidationResult struct {
+	ResourceName string
+	ResourceType string
+	// Error is nil if the discovery information is valid, but doesn't
+	// include any resource properties
+	Error error
+}
+
+// ValidateDiscoveryInfo generates the sparta.Discover information for every
+// resource in the template, without provisioning anything, and returns the
+// resources whose information is either invalid or doesn't include any
+// properties. The results are sorted by resource name.
+func ValidateDiscoveryInfo(cfTemplate *gocf.Template,
+	logger *logrus.Logger) []DiscoveryValidationResult {
+
+	resourceNames := make([]string, 0)
+	for eachName := range cfTemplate.Resources {
+		resourceNames = append(resourceNames, eachName)
+	}
+	sort.Strings(resourceNames)
+
+	validationResults := make([]DiscoveryValidationResult, 0)
+	for _, eachName := range resourceNames {
+		validationResult := DiscoveryValidationResult{
+			ResourceName: eachName,
+		}
+		resourceValue := resourcePropertiesValue(cfTemplate.Resources[eachName].Properties)
+		if resourceValue != nil {
+			validationResult.ResourceType = resourceValue.CfnResourceType()
+		}
+		discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(cfTemplate,
+			eachName,
+			nil,
+			logger)
+		if discoveryDataErr != nil {
+			validationResult.Error = discoveryDataErr
+			validationResults = append(validationResults, validationResult)
+			continue
+		}
+		resolvedResource, resolvedResourceErr := resolvedDiscoveryResource(eachName, discoveryData)
+		if resolvedResourceErr != nil {
+			validationResult.Error = resolvedResourceErr
+			validationResults = append(validationResults, validationResult)
+			continue
+		}
+		if len(resolvedResource.Properties) == 0 {
+			validationResults = append(validationResults, validationResult)
+		}
+	}
+	return validationResults
+}
+
 func safeAppendDependency(resource *gocf.Resource, dependencyName string) {
 	if nil == resource.DependsOn {
 		resource.DependsOn = []string{}
 	}
+	for _, eachDependency := range resource.DependsOn {
+		if eachDependency == dependencyName {
+			return
+		}
+	}
 	resource.DependsOn = append(resource.DependsOn, dependencyName)
 }
+
+// safeRemoveDependency removes every occurrence of dependencyName from the
+// resource's DependsOn list. The list is reset to nil when it's empty so
+// that the template doesn't include an empty DependsOn value.
+func safeRemoveDependency(resource *gocf.Resource, dependencyName string) {
+	remainingDependencies := []string{}
+	for _, eachDependency := range resource.DependsOn {
+		if eachDependency != dependencyName {
+			remainingDependencies = append(remainingDependencies, eachDependency)
+		}
+	}
+	if len(remainingDependencies) == 0 {
+		remainingDependencies = nil
+	}
+	resource.DependsOn = remainingDependencies
+}
+
+// DanglingReference is a reference to a logical name that isn't
+// defined in the template
+type DanglingReference struct {
+	// The resource that included the reference
+	ResourceName string
+	// The undefined logical name
+	Reference string
+	// Where the reference was found (eg, DependsOn)
+	Source string
+}
+
+// RemoveDanglingReferences removes the DependsOn entries and the discovery
+// information that reference resources which aren't defined in the template.
+// Discovery information is a single Fn::Join expression, so the environment
+// variable is removed if any of its references are undefined. The removed
+// references are returned, ordered by resource name.
+func RemoveDanglingReferences(cfTemplate *gocf.Template,
+	logger *logrus.Logger) ([]DanglingReference, error) {
+
+	isDefined := func(logicalName string) bool {
+		if strings.HasPrefix(logicalName, "AWS::") {
+			return true
+		}
+		_, resourceOk := cfTemplate.Resources[logicalName]
+		_, parameterOk := cfTemplate.Parameters[logicalName]
+		return resourceOk || parameterOk
+	}
+	resourceNames := make([]string, 0, len(cfTemplate.Resources))
+	for eachName := range cfTemplate.Resources {
+		resourceNames = append(resourceNames, eachName)
+	}
+	sort.Strings(resourceNames)
+
+	removedReferences := make([]DanglingReference, 0)
+	for _, eachName := range resourceNames {
+		eachResource := cfTemplate.Resources[eachName]
+		for _, eachDependency := range eachResource.DependsOn {
+			if isDefined(eachDependency) {
+				continue
+			}
+			logger.WithFields(logrus.Fields{
+				"Resource":  eachName,
+				"DependsOn": eachDependency,
+			}).Info("Removing dangling DependsOn reference")
+			safeRemoveDependency(eachResource, eachDependency)
+			removedReferences = append(removedReferences, DanglingReference{
+				ResourceName: eachName,
+				Reference:    eachDependency,
+				Source:       "DependsOn",
+			})
+		}
+		lambdaResource, lambdaResourceOk := resourcePropertiesValue(eachResource.Properties).(gocf.LambdaFunction)
+		if !lambdaResourceOk || lambdaResource.Environment == nil {
+			continue
+		}
+		environmentVars, environmentVarsOk := lambdaResource.Environment.Variables.(map[string]*gocf.StringExpr)
+		if !environmentVarsOk {
+			continue
+		}
+		environmentKey := discoveryEnvironmentKey(environmentVars)
+		if environmentVars[environmentKey] == nil {
+			continue
+		}
+		discoveryJSON, discoveryJSONErr := json.Marshal(environmentVars[environmentKey])
+		if discoveryJSONErr != nil {
+			return nil, discoveryJSONErr
+		}
+		var discoveryValue interface{}
+		unmarshalErr := json.Unmarshal(discoveryJSON, &discoveryValue)
+		if unmarshalErr != nil {
+			return nil, unmarshalErr
+		}
+		referenceNames := make(map[string]bool)
+		collectTemplateReferences(discoveryValue, referenceNames)
+		undefinedNames := make([]string, 0)
+		for eachReference := range referenceNames {
+			if !isDefined(eachReference) {
+				undefinedNames = append(undefinedNames, eachReference)
+			}
+		}
+		if len(undefinedNames) == 0 {
+			continue
+		}
+		sort.Strings(undefinedNames)
+		logger.WithFields(logrus.Fields{
+			"Resource":   eachName,
+			"References": undefinedNames,
+		}).Warn("Removing discovery information with dangling references")
+		delete(environmentVars, environmentKey)
+		delete(environmentVars, spartaEnvVarDiscoveryKey)
+		for _, eachReference := range undefinedNames {
+			removedReferences = append(removedReferences, DanglingReference{
+				ResourceName: eachName,
+				Reference:    eachReference,
+				Source:       environmentKey,
+			})
+		}
+	}
+	return removedReferences, nil
+}
+
 func safeMetadataInsert(resource *gocf.Resource, key string, value interface{}) {
 	if nil == resource.Metadata {
 		resource.Metadata = make(map[string]interface{})
@@ -150,47 +1327,877 @@ func safeMetadataInsert(resource *gocf.Resource, key string, value interface{})
 	resource.Metadata[key] = value
 }
 
-func safeMergeTemplates(sourceTemplate *gocf.Template, destTemplate *gocf.Template, logger *logrus.Logger) error {
-	var mergeErrors []string
-
-	// Append the custom resources
-	for eachKey, eachLambdaResource := range sourceTemplate.Resources {
-		_, exists := destTemplate.Resources[eachKey]
-		if exists {
-			errorMsg := fmt.Sprintf("Duplicate CloudFormation resource name: %s", eachKey)
-			mergeErrors = append(mergeErrors, errorMsg)
+// mergeMetadataValue returns the deep merge of the existing and incoming
+// metadata values. Nested map[string]interface{} values are merged key by key,
+// all other incoming values replace the existing value.
+func mergeMetadataValue(existingValue interface{}, incomingValue interface{}) interface{} {
+	existingMap, existingMapOk := existingValue.(map[string]interface{})
+	incomingMap, incomingMapOk := incomingValue.(map[string]interface{})
+	if !existingMapOk || !incomingMapOk {
+		return incomingValue
+	}
+	mergedMap := make(map[string]interface{}, len(existingMap)+len(incomingMap))
+	for eachKey, eachValue := range existingMap {
+		mergedMap[eachKey] = eachValue
+	}
+	for eachKey, eachValue := range incomingMap {
+		if existingEntry, existingEntryOk := mergedMap[eachKey]; existingEntryOk {
+			mergedMap[eachKey] = mergeMetadataValue(existingEntry, eachValue)
 		} else {
-			destTemplate.Resources[eachKey] = eachLambdaResource
+			mergedMap[eachKey] = eachValue
+		}
+	}
+	return mergedMap
+}
+
+// safeMetadataMerge is like safeMetadataInsert, except that an existing
+// map[string]interface{} value for key is deep merged with the incoming
+// map rather than being replaced. This allows several callers to contribute
+// entries to a shared metadata key (eg, AWS::CloudFormation::Init).
+func safeMetadataMerge(resource *gocf.Resource, key string, value interface{}) {
+	if nil == resource.Metadata {
+		resource.Metadata = make(map[string]interface{})
+	}
+	existingValue, existingValueOk := resource.Metadata[key]
+	if !existingValueOk {
+		resource.Metadata[key] = value
+		return
+	}
+	resource.Metadata[key] = mergeMetadataValue(existingValue, value)
+}
+
+// TemplateMergeConflict identifies a logical name that's defined by
+// both templates in a failed template merge
+type TemplateMergeConflict struct {
+	// Template section (eg, "Resources") that defines the name
+	Section string
+	// Logical name defined in both templates
+	Name string
+}
+
+// TemplateReferenceMismatch identifies a Ref or Fn::GetAtt reference in the
+// source template of a failed template merge whose target is either
+// undefined or has a different resource type in the merged template
+type TemplateReferenceMismatch struct {
+	// Logical name of the resource or output that includes the reference
+	Name string
+	// Referenced logical name
+	Target string
+	// Description of the mismatch
+	Reason string
+}
+
+// TemplateMergeError is returned when two CloudFormation templates can't be
+// merged because they define conflicting logical names or, if reference
+// checking is enabled, inconsistent references
+type TemplateMergeError struct {
+	Conflicts  []TemplateMergeConflict
+	References []TemplateReferenceMismatch
+}
+
+// Error returns the list of conflicts
+func (mergeErr *TemplateMergeError) Error() string {
+	errorText := "Template merge failed. The following collisions were found:"
+	for _, eachConflict := range mergeErr.Conflicts {
+		errorText += fmt.Sprintf("\n\tDuplicate CloudFormation %s name: %s",
+			eachConflict.Section,
+			eachConflict.Name)
+	}
+	for _, eachReference := range mergeErr.References {
+		errorText += fmt.Sprintf("\n\tInvalid reference from %s to %s: %s",
+			eachReference.Name,
+			eachReference.Target,
+			eachReference.Reason)
+	}
+	return errorText
+}
+
+// TemplateMergeStrategy determines how a logical name that's defined
+// in both the source and destination templates is merged
+type TemplateMergeStrategy int
+
+const (
+	// TemplateMergeFailOnConflict reports duplicate names as a merge error
+	TemplateMergeFailOnConflict TemplateMergeStrategy = iota
+	// TemplateMergePreferSource replaces the destination value with the
+	// source value
+	TemplateMergePreferSource
+	// TemplateMergePreferDest preserves the destination value
+	TemplateMergePreferDest
+)
+
+// TemplateMergeDescriptionPolicy determines how the source template's
+// Description is merged into the destination template
+type TemplateMergeDescriptionPolicy int
+
+const (
+	// TemplateMergeDescriptionPreserve leaves the destination Description unchanged
+	TemplateMergeDescriptionPreserve TemplateMergeDescriptionPolicy = iota
+	// TemplateMergeDescriptionReplace replaces the destination Description
+	// with a non-empty source Description
+	TemplateMergeDescriptionReplace
+	// TemplateMergeDescriptionAppend appends a non-empty source Description
+	// to the destination Description
+	TemplateMergeDescriptionAppend
+)
+
+// TemplateMergeOptions controls how a ServiceDecorator or TemplateDecorator
+// template is merged into the service template. See
+// WorkflowHooks.ServiceDecoratorMergeOptions and
+// LambdaAWSInfo.DecoratorMergeOptions. A nil value uses the default
+// options, which report duplicate names as a TemplateMergeError.
+type TemplateMergeOptions struct {
+	// Strategy for names defined in both templates
+	Strategy TemplateMergeStrategy
+	// Optional prefix applied to the source template's Resources, Mappings,
+	// and Outputs logical names before merging
+	Prefix string
+	// Verify the source template's Ref and Fn::GetAtt references
+	// after merging
+	CheckReferences bool
+	// Policy for the top level Description. The top level Metadata
+	// isn't merged as gocf.Template doesn't model it.
+	DescriptionPolicy TemplateMergeDescriptionPolicy
+	// Rename colliding source Outputs with a numeric suffix rather
+	// than applying the strategy. Other sections aren't renamed,
+	// as that would break references.
+	RenameOutputs bool
+}
+
+var reSubVariable = regexp.MustCompile(`\$\{([^!][^}.]*)(\.[^}]*)?\}`)
+
+// renameReferenceEntries updates the Ref, Fn::GetAtt, Fn::FindInMap,
+// and Fn::Sub references in the unmarshaled JSON object to use the
+// names in the renamed maps. Nested values aren't updated.
+func renameReferenceEntries(typedValue map[string]interface{},
+	renamedResources map[string]string,
+	renamedMappings map[string]string) {
+
+	for eachKey, eachValue := range typedValue {
+		switch eachKey {
+		case "Ref":
+			if refName, refNameOk := eachValue.(string); refNameOk {
+				typedValue[eachKey] = renamedReference(refName, renamedResources)
+			}
+		case "Fn::GetAtt":
+			switch typedAttr := eachValue.(type) {
+			case string:
+				attrParts := strings.SplitN(typedAttr, ".", 2)
+				attrParts[0] = renamedReference(attrParts[0], renamedResources)
+				typedValue[eachKey] = strings.Join(attrParts, ".")
+			case []interface{}:
+				if len(typedAttr) != 0 {
+					if resName, resNameOk := typedAttr[0].(string); resNameOk {
+						typedAttr[0] = renamedReference(resName, renamedResources)
+					}
+				}
+			}
+		case "Fn::FindInMap":
+			if mapArgs, mapArgsOk := eachValue.([]interface{}); mapArgsOk && len(mapArgs) != 0 {
+				if mapName, mapNameOk := mapArgs[0].(string); mapNameOk {
+					mapArgs[0] = renamedReference(mapName, renamedMappings)
+				}
+			}
+		case "Fn::Sub":
+			renameSub := func(subValue string) string {
+				return reSubVariable.ReplaceAllStringFunc(subValue, func(match string) string {
+					matchParts := reSubVariable.FindStringSubmatch(match)
+					if renamed, renamedOk := renamedResources[matchParts[1]]; renamedOk {
+						return fmt.Sprintf("${%s%s}", renamed, matchParts[2])
+					}
+					return match
+				})
+			}
+			switch typedSub := eachValue.(type) {
+			case string:
+				typedValue[eachKey] = renameSub(typedSub)
+			case []interface{}:
+				if len(typedSub) != 0 {
+					if subString, subStringOk := typedSub[0].(string); subStringOk {
+						typedSub[0] = renameSub(subString)
+					}
+				}
+			}
 		}
 	}
+}
 
-	// Append the custom Mappings
-	for eachKey, eachMapping := range sourceTemplate.Mappings {
-		_, exists := destTemplate.Mappings[eachKey]
-		if exists {
-			errorMsg := fmt.Sprintf("Duplicate CloudFormation Mapping name: %s", eachKey)
-			mergeErrors = append(mergeErrors, errorMsg)
-		} else {
-			destTemplate.Mappings[eachKey] = eachMapping
+// renamedReference returns the renamed logical name, or name if it
+// wasn't renamed
+func renamedReference(name string, renamedNames map[string]string) string {
+	if renamed, renamedOk := renamedNames[name]; renamedOk {
+		return renamed
+	}
+	return name
+}
+
+// collectTemplateReferences adds the logical names referenced by the Ref
+// and Fn::GetAtt functions in the unmarshaled JSON value to referenceNames
+func collectTemplateReferences(value interface{}, referenceNames map[string]bool) {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		for eachKey, eachValue := range typedValue {
+			switch eachKey {
+			case "Ref":
+				if refName, refNameOk := eachValue.(string); refNameOk {
+					referenceNames[refName] = true
+				}
+			case "Fn::GetAtt":
+				switch typedAttr := eachValue.(type) {
+				case string:
+					referenceNames[strings.SplitN(typedAttr, ".", 2)[0]] = true
+				case []interface{}:
+					if len(typedAttr) != 0 {
+						if resName, resNameOk := typedAttr[0].(string); resNameOk {
+							referenceNames[resName] = true
+						}
+					}
+				}
+			}
+			collectTemplateReferences(eachValue, referenceNames)
 		}
+	case []interface{}:
+		for _, eachValue := range typedValue {
+			collectTemplateReferences(eachValue, referenceNames)
+		}
+	}
+}
+
+// checkMergedReferences verifies that every Ref and Fn::GetAtt reference in
+// the source template's Resources and Outputs targets a logical name that's
+// defined in the merged destination template. References to resources
+// defined in the source template must target a resource of the same type.
+func checkMergedReferences(sourceTemplate *gocf.Template,
+	destTemplate *gocf.Template) ([]TemplateReferenceMismatch, error) {
+
+	referencingValues := make(map[string]interface{})
+	for eachName, eachResource := range sourceTemplate.Resources {
+		referencingValues[eachName] = eachResource.Properties
+	}
+	for eachName, eachOutput := range sourceTemplate.Outputs {
+		referencingValues[eachName] = eachOutput.Value
+	}
+	referencingNames := make([]string, 0)
+	for eachName := range referencingValues {
+		referencingNames = append(referencingNames, eachName)
 	}
+	sort.Strings(referencingNames)
+
+	var mismatches []TemplateReferenceMismatch
+	for _, eachName := range referencingNames {
+		jsonData, jsonDataErr := json.Marshal(referencingValues[eachName])
+		if jsonDataErr != nil {
+			return nil, jsonDataErr
+		}
+		var genericValue interface{}
+		unmarshalErr := json.Unmarshal(jsonData, &genericValue)
+		if unmarshalErr != nil {
+			return nil, unmarshalErr
+		}
+		referenceNames := make(map[string]bool)
+		collectTemplateReferences(genericValue, referenceNames)
+		targetNames := make([]string, 0)
+		for eachTarget := range referenceNames {
+			targetNames = append(targetNames, eachTarget)
+		}
+		sort.Strings(targetNames)
+
+		for _, eachTarget := range targetNames {
+			// Pseudo parameters (eg, AWS::Region) are always defined
+			if strings.HasPrefix(eachTarget, "AWS::") {
+				continue
+			}
+			if _, paramOk := destTemplate.Parameters[eachTarget]; paramOk {
+				continue
+			}
+			destResource, destResourceOk := destTemplate.Resources[eachTarget]
+			if !destResourceOk {
+				mismatches = append(mismatches, TemplateReferenceMismatch{
+					Name:   eachName,
+					Target: eachTarget,
+					Reason: "target is not defined",
+				})
+				continue
+			}
+			sourceResource, sourceResourceOk := sourceTemplate.Resources[eachTarget]
+			if !sourceResourceOk {
+				continue
+			}
+			sourceType := ""
+			if sourceValue := resourcePropertiesValue(sourceResource.Properties); sourceValue != nil {
+				sourceType = sourceValue.CfnResourceType()
+			}
+			destType := ""
+			if destValue := resourcePropertiesValue(destResource.Properties); destValue != nil {
+				destType = destValue.CfnResourceType()
+			}
+			if sourceType != destType {
+				mismatches = append(mismatches, TemplateReferenceMismatch{
+					Name:   eachName,
+					Target: eachTarget,
+					Reason: fmt.Sprintf("expected type %s, found %s", sourceType, destType),
+				})
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// renamedTemplateValue returns a deep copy of the value whose Ref,
+// Fn::GetAtt, Fn::FindInMap, and Fn::Sub references are renamed. The
+// copy preserves the concrete types and the fields that aren't
+// marshaled to JSON (eg, gocf.NestedStack Outputs).
+func renamedTemplateValue(value interface{},
+	renamedResources map[string]string,
+	renamedMappings map[string]string) interface{} {
+	if value == nil {
+		return nil
+	}
+	return renamedReflectValue(reflect.ValueOf(value),
+		renamedResources,
+		renamedMappings).Interface()
+}
+
+func renamedReflectValue(value reflect.Value,
+	renamedResources map[string]string,
+	renamedMappings map[string]string) reflect.Value {
+
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return value
+		}
+		copied := reflect.New(value.Type().Elem())
+		copied.Elem().Set(renamedReflectValue(value.Elem(), renamedResources, renamedMappings))
+		return copied
+	case reflect.Interface:
+		if value.IsNil() {
+			return value
+		}
+		copied := reflect.New(value.Type()).Elem()
+		copied.Set(renamedReflectValue(value.Elem(), renamedResources, renamedMappings))
+		return copied
+	case reflect.Struct:
+		// Start with a shallow copy so that unexported fields are preserved
+		copied := reflect.New(value.Type()).Elem()
+		copied.Set(value)
+		for i := 0; i != copied.NumField(); i++ {
+			if copied.Field(i).CanSet() {
+				copied.Field(i).Set(renamedReflectValue(value.Field(i),
+					renamedResources,
+					renamedMappings))
+			}
+		}
+		switch typedFunc := copied.Addr().Interface().(type) {
+		case *gocf.RefFunc:
+			typedFunc.Name = renamedReference(typedFunc.Name, renamedResources)
+		case *gocf.GetAttFunc:
+			typedFunc.Resource = renamedReference(typedFunc.Resource, renamedResources)
+		case *gocf.FindInMapFunc:
+			typedFunc.MapName = renamedReference(typedFunc.MapName, renamedMappings)
+		}
+		return copied
+	case reflect.Map:
+		if value.IsNil() {
+			return value
+		}
+		copied := reflect.MakeMap(value.Type())
+		for _, eachKey := range value.MapKeys() {
+			copied.SetMapIndex(eachKey, renamedReflectValue(value.MapIndex(eachKey),
+				renamedResources,
+				renamedMappings))
+		}
+		if genericValue, genericValueOk := copied.Interface().(map[string]interface{}); genericValueOk {
+			renameReferenceEntries(genericValue, renamedResources, renamedMappings)
+		}
+		return copied
+	case reflect.Slice:
+		if value.IsNil() {
+			return value
+		}
+		copied := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		for i := 0; i != value.Len(); i++ {
+			copied.Index(i).Set(renamedReflectValue(value.Index(i),
+				renamedResources,
+				renamedMappings))
+		}
+		return copied
+	case reflect.Array:
+		copied := reflect.New(value.Type()).Elem()
+		for i := 0; i != value.Len(); i++ {
+			copied.Index(i).Set(renamedReflectValue(value.Index(i),
+				renamedResources,
+				renamedMappings))
+		}
+		return copied
+	}
+	return value
+}
+
+// prefixedTemplate returns a copy of the template whose Resources, Mappings,
+// and Outputs logical names are prefixed. References to the renamed
+// Resources and Mappings are updated to use the new names.
+func prefixedTemplate(template *gocf.Template, prefix string) *gocf.Template {
+	renamedResources := make(map[string]string)
+	for eachKey := range template.Resources {
+		renamedResources[eachKey] = prefix + eachKey
+	}
+	renamedMappings := make(map[string]string)
+	for eachKey := range template.Mappings {
+		renamedMappings[eachKey] = prefix + eachKey
+	}
+
+	renamedTemplate := *template
+	renamedTemplate.Resources = make(map[string]*gocf.Resource)
+	for eachKey, eachResource := range template.Resources {
+		renamedResource := renamedTemplateValue(eachResource,
+			renamedResources,
+			renamedMappings).(*gocf.Resource)
+		for eachIndex, eachDependency := range renamedResource.DependsOn {
+			renamedResource.DependsOn[eachIndex] = renamedReference(eachDependency, renamedResources)
+		}
+		renamedTemplate.Resources[renamedResources[eachKey]] = renamedResource
+	}
+	renamedTemplate.Mappings = make(map[string]*gocf.Mapping)
+	for eachKey, eachMapping := range template.Mappings {
+		renamedTemplate.Mappings[renamedMappings[eachKey]] = eachMapping
+	}
+	renamedTemplate.Outputs = make(map[string]*gocf.Output)
+	for eachKey, eachOutput := range template.Outputs {
+		renamedTemplate.Outputs[prefix+eachKey] = renamedTemplateValue(eachOutput,
+			renamedResources,
+			renamedMappings).(*gocf.Output)
+	}
+	return &renamedTemplate
+}
+
+// mergeTemplateSection merges the sourceSection entries into the destSection,
+// where both values are the same template section map type (eg,
+// map[string]*gocf.Resource). Names that have equivalent definitions in
+// both templates are shared rather than treated as conflicts. The
+// collisions are the section's names reported by previewMerge.
+func mergeTemplateSection(sectionName string,
+	sourceSection interface{},
+	destSection interface{},
+	collisions []string,
+	options *TemplateMergeOptions,
+	logger *logrus.Logger) ([]string, []TemplateMergeConflict) {
+
+	mergedKeys := []string{}
+	var mergeConflicts []TemplateMergeConflict
+	sourceMap := reflect.ValueOf(sourceSection)
+	destMap := reflect.ValueOf(destSection)
+	for _, eachName := range collisions {
+		switch options.Strategy {
+		case TemplateMergePreferSource:
+			logger.WithFields(logrus.Fields{
+				"Section": sectionName,
+				"Name":    eachName,
+			}).Info("Replacing existing CloudFormation template entry")
+			nameValue := reflect.ValueOf(eachName)
+			destMap.SetMapIndex(nameValue, sourceMap.MapIndex(nameValue))
+			mergedKeys = append(mergedKeys, eachName)
+		case TemplateMergePreferDest:
+			logger.WithFields(logrus.Fields{
+				"Section": sectionName,
+				"Name":    eachName,
+			}).Info("Preserving existing CloudFormation template entry")
+		default:
+			mergeConflicts = append(mergeConflicts, TemplateMergeConflict{
+				Section: sectionName,
+				Name:    eachName,
+			})
+		}
+	}
+	// Copy the entries in sorted order so that the merge is reproducible
+	for _, eachKey := range sortedSectionKeys(sourceMap) {
+		if !destMap.MapIndex(eachKey).IsValid() {
+			logger.WithFields(logrus.Fields{
+				"Section": sectionName,
+				"Name":    eachKey.String(),
+			}).Debug("Merging CloudFormation template entry")
+			destMap.SetMapIndex(eachKey, sourceMap.MapIndex(eachKey))
+			mergedKeys = append(mergedKeys, eachKey.String())
+		}
+	}
+	sort.Strings(mergedKeys)
+	return mergedKeys, mergeConflicts
+}
+
+// sortedSectionKeys returns the keys of the template section map
+// in sorted order
+func sortedSectionKeys(sectionMap reflect.Value) []reflect.Value {
+	sectionKeys := sectionMap.MapKeys()
+	sort.Slice(sectionKeys, func(i, j int) bool {
+		return sectionKeys[i].String() < sectionKeys[j].String()
+	})
+	return sectionKeys
+}
+
+// templateEntryHash returns a stable hash of the template entry's
+// CloudFormation JSON representation
+func templateEntryHash(entry interface{}) (string, error) {
+	entryJSON, entryJSONErr := json.Marshal(entry)
+	if entryJSONErr != nil {
+		return "", entryJSONErr
+	}
+	entryHash := sha256.Sum256(entryJSON)
+	return hex.EncodeToString(entryHash[:]), nil
+}
+
+// templateEntriesEqual returns true if the entries produce the same
+// CloudFormation JSON, even if the Go values differ (eg, a pointer vs
+// value resource). Entries that can't be marshaled are compared
+// directly.
+func templateEntriesEqual(sourceEntry interface{}, destEntry interface{}) bool {
+	sourceHash, sourceHashErr := templateEntryHash(sourceEntry)
+	destHash, destHashErr := templateEntryHash(destEntry)
+	if sourceHashErr != nil || destHashErr != nil {
+		return reflect.DeepEqual(sourceEntry, destEntry)
+	}
+	return sourceHash == destHash
+}
+
+// templateSectionCollisions returns the sorted names that have different
+// definitions in the source and destination sections, where both values
+// are the same template section map type. Neither section is modified.
+func templateSectionCollisions(sourceSection interface{}, destSection interface{}) []string {
+	collisions := []string{}
+	sourceMap := reflect.ValueOf(sourceSection)
+	destMap := reflect.ValueOf(destSection)
+	for _, eachKey := range sourceMap.MapKeys() {
+		destValue := destMap.MapIndex(eachKey)
+		if destValue.IsValid() &&
+			!templateEntriesEqual(sourceMap.MapIndex(eachKey).Interface(), destValue.Interface()) {
+			collisions = append(collisions, eachKey.String())
+		}
+	}
+	sort.Strings(collisions)
+	return collisions
+}
+
+// previewMerge returns the names, grouped by template section, that would
+// collide if the source template were merged into the destination
+// template. Sections without collisions aren't included. Neither
+// template is modified.
+func previewMerge(sourceTemplate *gocf.Template, destTemplate *gocf.Template) map[string][]string {
+	destSections := templateSections(destTemplate)
+	sectionCollisions := make(map[string][]string)
+	for eachSection, eachSourceSection := range templateSections(sourceTemplate) {
+		collisions := templateSectionCollisions(eachSourceSection, destSections[eachSection])
+		if len(collisions) != 0 {
+			sectionCollisions[eachSection] = collisions
+		}
+	}
+	return sectionCollisions
+}
+
+// templateSectionDiff lists the names in a template section that differ
+// between two versions of a template
+type templateSectionDiff struct {
+	Added   []string
+	Changed []string
+	Removed []string
+}
+
+// templateSections returns the template section maps, keyed by section name
+func templateSections(template *gocf.Template) map[string]interface{} {
+	return map[string]interface{}{
+		"Resources":  template.Resources,
+		"Mappings":   template.Mappings,
+		"Parameters": template.Parameters,
+		"Conditions": template.Conditions,
+		"Outputs":    template.Outputs,
+	}
+}
+
+// templateSnapshot returns a copy of the template with new section maps.
+// The section values are shared with the original template, which is
+// sufficient to diff a template before and after a merge as merging
+// replaces section values rather than modifying them.
+func templateSnapshot(template *gocf.Template) *gocf.Template {
+	snapshot := *template
+	snapshot.Resources = make(map[string]*gocf.Resource, len(template.Resources))
+	for eachKey, eachValue := range template.Resources {
+		snapshot.Resources[eachKey] = eachValue
+	}
+	snapshot.Mappings = make(map[string]*gocf.Mapping, len(template.Mappings))
+	for eachKey, eachValue := range template.Mappings {
+		snapshot.Mappings[eachKey] = eachValue
+	}
+	snapshot.Parameters = make(map[string]*gocf.Parameter, len(template.Parameters))
+	for eachKey, eachValue := range template.Parameters {
+		snapshot.Parameters[eachKey] = eachValue
+	}
+	snapshot.Conditions = make(map[string]interface{}, len(template.Conditions))
+	for eachKey, eachValue := range template.Conditions {
+		snapshot.Conditions[eachKey] = eachValue
+	}
+	snapshot.Outputs = make(map[string]*gocf.Output, len(template.Outputs))
+	for eachKey, eachValue := range template.Outputs {
+		snapshot.Outputs[eachKey] = eachValue
+	}
+	return &snapshot
+}
+
+// diffTemplates returns the names, grouped by template section, that were
+// added, changed, or removed between the before and after templates (eg,
+// a templateSnapshot taken before safeMergeTemplates and the merged
+// template). Sections without differences aren't included.
+func diffTemplates(beforeTemplate *gocf.Template,
+	afterTemplate *gocf.Template) map[string]*templateSectionDiff {
+
+	templateDiff := make(map[string]*templateSectionDiff)
+	beforeSections := templateSections(beforeTemplate)
+	for eachSection, eachAfterSection := range templateSections(afterTemplate) {
+		beforeMap := reflect.ValueOf(beforeSections[eachSection])
+		afterMap := reflect.ValueOf(eachAfterSection)
+		sectionDiff := &templateSectionDiff{}
+		for _, eachKey := range afterMap.MapKeys() {
+			beforeValue := beforeMap.MapIndex(eachKey)
+			if !beforeValue.IsValid() {
+				sectionDiff.Added = append(sectionDiff.Added, eachKey.String())
+			} else if !reflect.DeepEqual(beforeValue.Interface(), afterMap.MapIndex(eachKey).Interface()) {
+				sectionDiff.Changed = append(sectionDiff.Changed, eachKey.String())
+			}
+		}
+		for _, eachKey := range beforeMap.MapKeys() {
+			if !afterMap.MapIndex(eachKey).IsValid() {
+				sectionDiff.Removed = append(sectionDiff.Removed, eachKey.String())
+			}
+		}
+		if len(sectionDiff.Added) != 0 ||
+			len(sectionDiff.Changed) != 0 ||
+			len(sectionDiff.Removed) != 0 {
+			sort.Strings(sectionDiff.Added)
+			sort.Strings(sectionDiff.Changed)
+			sort.Strings(sectionDiff.Removed)
+			templateDiff[eachSection] = sectionDiff
+		}
+	}
+	return templateDiff
+}
+
+// renamedTemplateOutputs returns a copy of the source Outputs where each
+// output that collides with a different destination output is renamed
+// with the first available numeric suffix. The renamed outputs are
+// returned, keyed by their original name. Neither section is modified.
+func renamedTemplateOutputs(sourceOutputs map[string]*gocf.Output,
+	destOutputs map[string]*gocf.Output,
+	logger *logrus.Logger) (map[string]*gocf.Output, map[string]string) {
+
+	collisions := templateSectionCollisions(sourceOutputs, destOutputs)
+	if len(collisions) == 0 {
+		return sourceOutputs, nil
+	}
+	renamedOutputs := make(map[string]*gocf.Output, len(sourceOutputs))
+	for eachName, eachOutput := range sourceOutputs {
+		renamedOutputs[eachName] = eachOutput
+	}
+	renamedNames := make(map[string]string)
+	for _, eachName := range collisions {
+		renamedName := ""
+		for suffix := 2; ; suffix++ {
+			renamedName = fmt.Sprintf("%s%d", eachName, suffix)
+			_, destExists := destOutputs[renamedName]
+			_, renamedExists := renamedOutputs[renamedName]
+			if !destExists && !renamedExists {
+				break
+			}
+		}
+		logger.WithFields(logrus.Fields{
+			"Name":        eachName,
+			"RenamedName": renamedName,
+		}).Info("Renaming colliding CloudFormation Output")
+		renamedOutputs[renamedName] = renamedOutputs[eachName]
+		delete(renamedOutputs, eachName)
+		renamedNames[eachName] = renamedName
+	}
+	return renamedOutputs, renamedNames
+}
+
+// templateMergeSummary lists the logical names, by template section, that
+// were copied from the source template into the destination template
+type templateMergeSummary struct {
+	Resources  []string
+	Mappings   []string
+	Parameters []string
+	Conditions []string
+	Outputs    []string
+	// Renamed source Outputs, keyed by the original name
+	RenamedOutputs map[string]string
+}
+
+// safeMergeTemplates merges the source template into the destination
+// template with the default TemplateMergeOptions. Duplicate names are
+// reported as a TemplateMergeError.
+func safeMergeTemplates(sourceTemplate *gocf.Template, destTemplate *gocf.Template, logger *logrus.Logger) error {
+	return safeMergeTemplatesWithOptions(sourceTemplate, destTemplate, nil, logger)
+}
+
+func safeMergeTemplatesWithOptions(sourceTemplate *gocf.Template,
+	destTemplate *gocf.Template,
+	options *TemplateMergeOptions,
+	logger *logrus.Logger) error {
+	_, mergeErr := safeMergeTemplatesWithSummary(sourceTemplate, destTemplate, options, logger)
+	return mergeErr
+}
+
+// safeMergeTemplatesWithSummary merges the source template into the
+// destination template and returns the logical names that were
+// copied into the destination template. The top level Transform
+// and Rules sections aren't merged, as gocf.Template doesn't
+// define them.
+func safeMergeTemplatesWithSummary(sourceTemplate *gocf.Template,
+	destTemplate *gocf.Template,
+	options *TemplateMergeOptions,
+	logger *logrus.Logger) (*templateMergeSummary, error) {
+
+	if options == nil {
+		options = &TemplateMergeOptions{}
+	}
+	if options.Prefix != "" {
+		sourceTemplate = prefixedTemplate(sourceTemplate, options.Prefix)
+	}
+	// Templates that weren't created by gocf.NewTemplate
+	// may not have initialized maps
+	if destTemplate.Resources == nil {
+		destTemplate.Resources = make(map[string]*gocf.Resource)
+	}
+	if destTemplate.Mappings == nil {
+		destTemplate.Mappings = make(map[string]*gocf.Mapping)
+	}
+	if destTemplate.Parameters == nil {
+		destTemplate.Parameters = make(map[string]*gocf.Parameter)
+	}
+	if destTemplate.Conditions == nil {
+		destTemplate.Conditions = make(map[string]interface{})
+	}
+	if destTemplate.Outputs == nil {
+		destTemplate.Outputs = make(map[string]*gocf.Output)
+	}
+	// The sections are independent, so every collision can be
+	// found before any section is merged
+	collisions := previewMerge(sourceTemplate, destTemplate)
+	var mergeConflicts []TemplateMergeConflict
+	summary := &templateMergeSummary{}
+	var sectionConflicts []TemplateMergeConflict
+
+	// Append the custom resources. Identical definitions in any
+	// section are shared.
+	summary.Resources, sectionConflicts = mergeTemplateSection("Resources",
+		sourceTemplate.Resources,
+		destTemplate.Resources,
+		collisions["Resources"],
+		options,
+		logger)
+	mergeConflicts = append(mergeConflicts, sectionConflicts...)
+
+	// Append the custom Mappings
+	summary.Mappings, sectionConflicts = mergeTemplateSection("Mappings",
+		sourceTemplate.Mappings,
+		destTemplate.Mappings,
+		collisions["Mappings"],
+		options,
+		logger)
+	mergeConflicts = append(mergeConflicts, sectionConflicts...)
+
+	// Append the custom Parameters
+	summary.Parameters, sectionConflicts = mergeTemplateSection("Parameters",
+		sourceTemplate.Parameters,
+		destTemplate.Parameters,
+		collisions["Parameters"],
+		options,
+		logger)
+	mergeConflicts = append(mergeConflicts, sectionConflicts...)
+
+	// Append the custom Conditions
+	summary.Conditions, sectionConflicts = mergeTemplateSection("Conditions",
+		sourceTemplate.Conditions,
+		destTemplate.Conditions,
+		collisions["Conditions"],
+		options,
+		logger)
+	mergeConflicts = append(mergeConflicts, sectionConflicts...)
 
 	// Append the custom outputs
-	for eachKey, eachLambdaOutput := range sourceTemplate.Outputs {
-		_, exists := destTemplate.Outputs[eachKey]
-		if exists {
-			errorMsg := fmt.Sprintf("Duplicate CloudFormation output key name: %s", eachKey)
-			mergeErrors = append(mergeErrors, errorMsg)
-		} else {
-			destTemplate.Outputs[eachKey] = eachLambdaOutput
+	sourceOutputs := sourceTemplate.Outputs
+	outputCollisions := collisions["Outputs"]
+	if options.RenameOutputs {
+		// Every colliding output is renamed
+		sourceOutputs, summary.RenamedOutputs = renamedTemplateOutputs(sourceTemplate.Outputs,
+			destTemplate.Outputs,
+			logger)
+		outputCollisions = nil
+	}
+	summary.Outputs, sectionConflicts = mergeTemplateSection("Outputs",
+		sourceOutputs,
+		destTemplate.Outputs,
+		outputCollisions,
+		options,
+		logger)
+	mergeConflicts = append(mergeConflicts, sectionConflicts...)
+
+	var referenceMismatches []TemplateReferenceMismatch
+	if options.CheckReferences {
+		mismatches, mismatchesErr := checkMergedReferences(sourceTemplate, destTemplate)
+		if mismatchesErr != nil {
+			return nil, mismatchesErr
 		}
+		referenceMismatches = mismatches
 	}
-	if len(mergeErrors) > 0 {
+
+	if len(mergeConflicts) > 0 || len(referenceMismatches) > 0 {
 		logger.Error("Failed to update template. The following collisions were found:")
-		for _, eachError := range mergeErrors {
-			logger.Error("\t" + eachError)
+		for _, eachConflict := range mergeConflicts {
+			logger.WithFields(logrus.Fields{
+				"Section": eachConflict.Section,
+				"Name":    eachConflict.Name,
+			}).Error("\tDuplicate CloudFormation name")
+		}
+		for _, eachReference := range referenceMismatches {
+			logger.WithFields(logrus.Fields{
+				"Name":   eachReference.Name,
+				"Target": eachReference.Target,
+				"Reason": eachReference.Reason,
+			}).Error("\tInvalid CloudFormation reference")
+		}
+		return nil, &TemplateMergeError{
+			Conflicts:  mergeConflicts,
+			References: referenceMismatches,
 		}
-		return errors.New("Template merge failed")
+	}
+	if sourceTemplate.Description != "" {
+		switch options.DescriptionPolicy {
+		case TemplateMergeDescriptionReplace:
+			destTemplate.Description = sourceTemplate.Description
+		case TemplateMergeDescriptionAppend:
+			if destTemplate.Description == "" {
+				destTemplate.Description = sourceTemplate.Description
+			} else {
+				destTemplate.Description = fmt.Sprintf("%s %s",
+					destTemplate.Description,
+					sourceTemplate.Description)
+			}
+		}
+	}
+	return summary, nil
+}
+
+// MaxTemplateSize is the optional maximum size, in bytes, of the
+// provisioned CloudFormation template's JSON representation. Provisioning
+// fails before the template is uploaded if it's exceeded. CloudFormation
+// limits inline template bodies to 51,200 bytes and templates uploaded to
+// S3 to 1MB. Zero disables the check.
+var MaxTemplateSize = 0
+
+// checkTemplateSize returns an error if the template's JSON representation
+// exceeds sizeLimit bytes. A sizeLimit of zero disables the check.
+func checkTemplateSize(templateJSON []byte, sizeLimit int) error {
+	if sizeLimit > 0 && len(templateJSON) > sizeLimit {
+		return fmt.Errorf("CloudFormation template size (%d bytes) exceeds limit of %d bytes",
+			len(templateJSON),
+			sizeLimit)
 	}
 	return nil
 }
@@ -0,0 +1,2260 @@
+package sparta
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
+	gocf "github.com/mweagle/go-cloudformation"
+)
+
+// resolveDiscoveryData simulates the CloudFormation resolution of the
+// discovery data for a dependency. The payload is transformed into
+// the Fn::Join expression that's included in the template and the
+// Ref and Fn::GetAtt values are replaced with placeholder values.
+func resolveDiscoveryData(discoveryData []byte) (string, error) {
+	joinExpr, joinExprErr := spartaCF.ConvertToTemplateExpression(bytes.NewReader(discoveryData), nil)
+	if joinExprErr != nil {
+		return "", joinExprErr
+	}
+	joinJSON, joinJSONErr := json.Marshal(joinExpr)
+	if joinJSONErr != nil {
+		return "", joinJSONErr
+	}
+	return resolveJoinExpression(joinJSON)
+}
+
+// resolveJoinExpression replaces the Ref and Fn::GetAtt values in the
+// marshaled Fn::Join expression with placeholder values and returns
+// the joined string.
+func resolveJoinExpression(joinJSON []byte) (string, error) {
+	var parsedJoin struct {
+		FnJoin []interface{} `json:"Fn::Join"`
+	}
+	unmarshalErr := json.Unmarshal(joinJSON, &parsedJoin)
+	if unmarshalErr != nil {
+		return "", unmarshalErr
+	}
+	if len(parsedJoin.FnJoin) != 2 {
+		return "", fmt.Errorf("Unexpected Fn::Join expression: %s", string(joinJSON))
+	}
+	joinItems, joinItemsOk := parsedJoin.FnJoin[1].([]interface{})
+	if !joinItemsOk {
+		return "", fmt.Errorf("Unexpected Fn::Join items: %s", string(joinJSON))
+	}
+	var resolved bytes.Buffer
+	for _, eachItem := range joinItems {
+		switch typedItem := eachItem.(type) {
+		case string:
+			resolved.WriteString(typedItem)
+		case map[string]interface{}:
+			if refName, refNameOk := typedItem["Ref"]; refNameOk {
+				resolved.WriteString(fmt.Sprintf("physical-%s", refName))
+			} else if attrParts, attrPartsOk := typedItem["Fn::GetAtt"].([]interface{}); attrPartsOk {
+				resolved.WriteString(fmt.Sprintf("%s.%s", attrParts[0], attrParts[1]))
+			} else {
+				return "", fmt.Errorf("Unsupported function: %#v", typedItem)
+			}
+		default:
+			return "", fmt.Errorf("Unsupported Fn::Join item: %#v", typedItem)
+		}
+	}
+	return resolved.String(), nil
+}
+
+// resolveDiscoveryResource resolves the discovery data for a single
+// dependency and unmarshals it into a DiscoveryResource
+func resolveDiscoveryResource(t *testing.T, discoveryData []byte) DiscoveryResource {
+	resolvedData, resolvedDataErr := resolveDiscoveryData(discoveryData)
+	if resolvedDataErr != nil {
+		t.Fatalf("Failed to resolve discovery data: %s\n%s", resolvedDataErr, discoveryData)
+	}
+	var resource DiscoveryResource
+	unmarshalErr := json.Unmarshal([]byte(resolvedData), &resource)
+	if unmarshalErr != nil {
+		t.Fatalf("Failed to unmarshal DiscoveryResource: %s\n%s", unmarshalErr, resolvedData)
+	}
+	return resource
+}
+
+// resolveDiscoveryInfo resolves the Fn::Base64 discovery information
+// environment value and unmarshals it into a DiscoveryInfo. The value
+// must include the Ref and Fn::GetAtt expressions as function objects
+// so that CloudFormation substitutes the physical values.
+func resolveDiscoveryInfo(t *testing.T, environmentValue *gocf.StringExpr) DiscoveryInfo {
+	var base64Value struct {
+		FnBase64 json.RawMessage `json:"Fn::Base64"`
+	}
+	environmentJSON, _ := json.Marshal(environmentValue)
+	unmarshalErr := json.Unmarshal(environmentJSON, &base64Value)
+	if unmarshalErr != nil {
+		t.Fatalf("Failed to unmarshal environment value: %s\n%s", unmarshalErr, environmentJSON)
+	}
+	resolvedData, resolvedDataErr := resolveJoinExpression(base64Value.FnBase64)
+	if resolvedDataErr != nil {
+		t.Fatalf("Failed to resolve environment value: %s\n%s", resolvedDataErr, environmentJSON)
+	}
+	var discoveryInfo DiscoveryInfo
+	unmarshalErr = json.Unmarshal([]byte(resolvedData), &discoveryInfo)
+	if unmarshalErr != nil {
+		t.Fatalf("Failed to unmarshal DiscoveryInfo: %s\n%s", unmarshalErr, resolvedData)
+	}
+	return discoveryInfo
+}
+
+// testAWSResource is a user-defined resource for an AWS resource type
+// that doesn't have a go-cloudformation definition
+type testAWSResource struct {
+	resourceType string
+}
+
+func (resource testAWSResource) CfnResourceType() string {
+	return resource.resourceType
+}
+
+// discoveryPropertiesTests are the resolved discovery properties that
+// are published for each dependency. Ref values resolve to
+// physical-<Name> and Fn::GetAtt values resolve to <Name>.<Attribute>.
+var discoveryPropertiesTests = []struct {
+	resourceName string
+	resource     gocf.ResourceProperties
+	properties   map[string]string
+}{
+	{
+		resourceName: "MyAPI",
+		resource: &testAWSResource{
+			resourceType: "AWS::ApiGatewayV2::Api",
+		},
+		properties: map[string]string{
+			"ApiEndpoint": "MyAPI.ApiEndpoint",
+			"ApiId":       "physical-MyAPI",
+		},
+	},
+	{
+		resourceName: "MyApplication",
+		resource: &testAWSResource{
+			resourceType: "AWS::AppConfig::Application",
+		},
+		properties: map[string]string{
+			"ApplicationId": "physical-MyApplication",
+		},
+	},
+	{
+		resourceName: "MyProfile",
+		resource: &testAWSResource{
+			resourceType: "AWS::AppConfig::ConfigurationProfile",
+		},
+		properties: map[string]string{
+			"ConfigurationProfileId": "physical-MyProfile",
+		},
+	},
+	{
+		resourceName: "MyEnvironment",
+		resource: &testAWSResource{
+			resourceType: "AWS::AppConfig::Environment",
+		},
+		properties: map[string]string{
+			"EnvironmentId": "physical-MyEnvironment",
+		},
+	},
+	{
+		resourceName: "MyAlarm",
+		resource:     &gocf.CloudWatchAlarm{},
+		properties: map[string]string{
+			"AlarmName": "physical-MyAlarm",
+			"Arn":       "MyAlarm.Arn",
+		},
+	},
+	{
+		resourceName: "MyCompositeAlarm",
+		resource: &testAWSResource{
+			resourceType: "AWS::CloudWatch::CompositeAlarm",
+		},
+		properties: map[string]string{
+			"AlarmName": "physical-MyCompositeAlarm",
+			"Arn":       "MyCompositeAlarm.Arn",
+		},
+	},
+	{
+		resourceName: "MyService",
+		resource: &gocf.ECSService{
+			LaunchType: gocf.String("FARGATE"),
+		},
+		properties: map[string]string{
+			"Name":       "MyService.Name",
+			"ServiceArn": "physical-MyService",
+		},
+	},
+	{
+		resourceName: "MyTaskDefinition",
+		resource:     &gocf.ECSTaskDefinition{},
+		properties: map[string]string{
+			"TaskDefinitionArn": "physical-MyTaskDefinition",
+		},
+	},
+	{
+		resourceName: "MyCrawler",
+		resource:     &gocf.GlueCrawler{},
+		properties: map[string]string{
+			"CrawlerName": "physical-MyCrawler",
+		},
+	},
+	{
+		resourceName: "MyGlueDatabase",
+		resource:     &gocf.GlueDatabase{},
+		properties: map[string]string{
+			"DatabaseName": "physical-MyGlueDatabase",
+		},
+	},
+	{
+		resourceName: "MyJob",
+		resource:     &gocf.GlueJob{},
+		properties: map[string]string{
+			"JobName": "physical-MyJob",
+		},
+	},
+	{
+		resourceName: "MyAnalyticsApplication",
+		resource: &testAWSResource{
+			resourceType: "AWS::KinesisAnalyticsV2::Application",
+		},
+		properties: map[string]string{
+			"ApplicationName": "physical-MyAnalyticsApplication",
+			"Arn":             "arn:physical-AWS::Partition:kinesisanalytics:physical-AWS::Region:physical-AWS::AccountId:application/physical-MyAnalyticsApplication",
+		},
+	},
+	{
+		resourceName: "MyAlias",
+		resource: &gocf.LambdaAlias{
+			FunctionName:    gocf.Ref("MyFunction").String(),
+			FunctionVersion: gocf.GetAtt("MyVersion", "Version"),
+			Name:            gocf.String("live"),
+		},
+		properties: map[string]string{
+			"AliasArn": "physical-MyAlias",
+		},
+	},
+	{
+		resourceName: "MyVersion",
+		resource: &gocf.LambdaVersion{
+			FunctionName: gocf.Ref("MyFunction").String(),
+		},
+		properties: map[string]string{
+			"Version": "MyVersion.Version",
+		},
+	},
+	{
+		resourceName: "MyLayer",
+		resource: &testAWSResource{
+			resourceType: "AWS::Lambda::LayerVersion",
+		},
+		properties: map[string]string{
+			"LayerVersionArn": "physical-MyLayer",
+		},
+	},
+	{
+		resourceName: "MyStack",
+		resource: &NestedStack{
+			CloudFormationStack: gocf.CloudFormationStack{
+				TemplateURL: gocf.String("https://s3.amazonaws.com/bucket/child.json"),
+			},
+			Outputs: []string{"Endpoint"},
+		},
+		properties: map[string]string{
+			"Outputs.Endpoint": "MyStack.Outputs.Endpoint",
+			"StackId":          "physical-MyStack",
+		},
+	},
+	{
+		resourceName: "MyCNAMERecord",
+		resource: &gocf.Route53RecordSet{
+			HostedZoneName:  gocf.String("example.com."),
+			Name:            gocf.String("api.example.com."),
+			ResourceRecords: gocf.StringList(gocf.String("origin.example.com")),
+			TTL:             gocf.String("300"),
+			Type:            gocf.String("CNAME"),
+		},
+		properties: map[string]string{
+			"HostedZoneName": "example.com.",
+			"Name":           "physical-MyCNAMERecord",
+		},
+	},
+	{
+		resourceName: "MyAliasRecord",
+		resource: &gocf.Route53RecordSet{
+			AliasTarget: &gocf.Route53RecordSetAliasTarget{
+				DNSName:      gocf.GetAtt("MyDistribution", "DomainName"),
+				HostedZoneID: gocf.String("Z2FDTNDATAQYW2"),
+			},
+			HostedZoneID: gocf.Ref("MyHostedZone").String(),
+			Name:         gocf.String("www.example.com."),
+			Type:         gocf.String("A"),
+		},
+		properties: map[string]string{
+			"Name": "physical-MyAliasRecord",
+		},
+	},
+	{
+		resourceName: "MySecret",
+		resource: &testAWSResource{
+			resourceType: "AWS::SecretsManager::Secret",
+		},
+		properties: map[string]string{
+			"Arn": "physical-MySecret",
+		},
+	},
+	{
+		resourceName: "MyTopic",
+		resource:     &gocf.SNSTopic{},
+		properties: map[string]string{
+			"Arn":       "physical-MyTopic",
+			"TopicName": "MyTopic.TopicName",
+		},
+	},
+	{
+		resourceName: "MyAlertsTopic",
+		resource: &gocf.SNSTopic{
+			DisplayName: gocf.String(`My "Alerts"`),
+		},
+		properties: map[string]string{
+			"Arn":         "physical-MyAlertsTopic",
+			"DisplayName": `My "Alerts"`,
+			"TopicName":   "MyAlertsTopic.TopicName",
+		},
+	},
+	{
+		resourceName: "MyStateMachine",
+		resource:     &gocf.StepFunctionsStateMachine{},
+		properties: map[string]string{
+			"Arn":  "physical-MyStateMachine",
+			"Name": "MyStateMachine.Name",
+		},
+	},
+	{
+		resourceName: "MyTimestreamDatabase",
+		resource: &testAWSResource{
+			resourceType: "AWS::Timestream::Database",
+		},
+		properties: map[string]string{
+			"Arn":          "MyTimestreamDatabase.Arn",
+			"DatabaseName": "physical-MyTimestreamDatabase",
+		},
+	},
+	{
+		resourceName: "MyTimestreamTable",
+		resource: &testAWSResource{
+			resourceType: "AWS::Timestream::Table",
+		},
+		properties: map[string]string{
+			"Arn":  "MyTimestreamTable.Arn",
+			"Name": "MyTimestreamTable.Name",
+		},
+	},
+	{
+		resourceName: "MyRole",
+		resource:     &gocf.IAMRole{},
+		properties: map[string]string{
+			"Arn": "MyRole.Arn",
+		},
+	},
+	{
+		resourceName: "MyFunction",
+		resource:     &gocf.LambdaFunction{},
+		properties: map[string]string{
+			"Arn": "MyFunction.Arn",
+		},
+	},
+	{
+		resourceName: "MyStream",
+		resource:     &gocf.KinesisStream{},
+		properties: map[string]string{
+			"Arn":  "MyStream.Arn",
+			"Name": "physical-MyStream",
+		},
+	},
+	{
+		resourceName: "MyDomain",
+		resource:     &gocf.ElasticsearchDomain{},
+		properties: map[string]string{
+			"DomainArn":      "MyDomain.DomainArn",
+			"DomainEndpoint": "MyDomain.DomainEndpoint",
+		},
+	},
+	{
+		resourceName: "MyDBInstance",
+		resource:     &gocf.RDSDBInstance{},
+		properties: map[string]string{
+			"Endpoint.Address": "MyDBInstance.Endpoint.Address",
+			"Endpoint.Port":    "MyDBInstance.Endpoint.Port",
+		},
+	},
+	{
+		resourceName: "MyRestAPI",
+		resource:     &gocf.APIGatewayRestAPI{},
+		properties: map[string]string{
+			"RestApiId":      "physical-MyRestAPI",
+			"RootResourceId": "MyRestAPI.RootResourceId",
+		},
+	},
+	{
+		resourceName: "MyDistribution",
+		resource:     &gocf.CloudFrontDistribution{},
+		properties: map[string]string{
+			"DistributionId": "physical-MyDistribution",
+			"DomainName":     "MyDistribution.DomainName",
+		},
+	},
+	{
+		resourceName: "MyUserPool",
+		resource:     &gocf.CognitoUserPool{},
+		properties: map[string]string{
+			"Arn":          "MyUserPool.Arn",
+			"ProviderName": "MyUserPool.ProviderName",
+			"ProviderURL":  "MyUserPool.ProviderURL",
+			"UserPoolId":   "physical-MyUserPool",
+		},
+	},
+	{
+		resourceName: "MyWebACL",
+		resource: &testAWSResource{
+			resourceType: "AWS::WAFv2::WebACL",
+		},
+		properties: map[string]string{
+			"Arn": "MyWebACL.Arn",
+			"Id":  "MyWebACL.Id",
+		},
+	},
+	{
+		resourceName: "MyFileSystem",
+		resource:     &gocf.EFSFileSystem{},
+		properties: map[string]string{
+			"Arn":          "MyFileSystem.Arn",
+			"FileSystemId": "physical-MyFileSystem",
+		},
+	},
+	{
+		resourceName: "MyHostedZone",
+		resource: &gocf.Route53HostedZone{
+			Name: gocf.String("example.com"),
+		},
+		properties: map[string]string{
+			"HostedZoneId": "physical-MyHostedZone",
+		},
+	},
+	{
+		resourceName: "MyCertificate",
+		resource: &gocf.CertificateManagerCertificate{
+			DomainName: gocf.String("example.com"),
+		},
+		properties: map[string]string{
+			"Arn": "physical-MyCertificate",
+		},
+	},
+	{
+		resourceName: "MyInstance",
+		resource:     &gocf.EC2Instance{},
+		properties: map[string]string{
+			"InstanceId":     "physical-MyInstance",
+			"PrivateDnsName": "MyInstance.PrivateDnsName",
+			"PrivateIp":      "MyInstance.PrivateIp",
+			"PublicDnsName":  "MyInstance.PublicDnsName",
+		},
+	},
+	{
+		resourceName: "MySubscription",
+		resource: &gocf.SNSSubscription{
+			Protocol: gocf.String("lambda"),
+		},
+		properties: map[string]string{
+			"Arn": "physical-MySubscription",
+		},
+	},
+	{
+		resourceName: "MyGraphQLAPI",
+		resource: &testAWSResource{
+			resourceType: "AWS::AppSync::GraphQLApi",
+		},
+		properties: map[string]string{
+			"ApiId":      "MyGraphQLAPI.ApiId",
+			"Arn":        "MyGraphQLAPI.Arn",
+			"GraphQLUrl": "MyGraphQLAPI.GraphQLUrl",
+		},
+	},
+	{
+		resourceName: "MyDeliveryStream",
+		resource:     &gocf.KinesisFirehoseDeliveryStream{},
+		properties: map[string]string{
+			"Arn": "MyDeliveryStream.Arn",
+		},
+	},
+	{
+		resourceName: "MyEventSourceMapping",
+		resource:     &gocf.LambdaEventSourceMapping{},
+		properties: map[string]string{
+			"EventSourceMappingId": "physical-MyEventSourceMapping",
+		},
+	},
+	{
+		resourceName: "MySecurityGroup",
+		resource:     &gocf.EC2SecurityGroup{},
+		properties: map[string]string{
+			"GroupId": "MySecurityGroup.GroupId",
+			"VpcId":   "MySecurityGroup.VpcId",
+		},
+	},
+	{
+		resourceName: "MyIdentityPool",
+		resource:     &gocf.CognitoIDentityPool{},
+		properties: map[string]string{
+			"IdentityPoolId": "physical-MyIdentityPool",
+			"Name":           "MyIdentityPool.Name",
+		},
+	},
+	{
+		resourceName: "MyBucket",
+		resource:     &gocf.S3Bucket{},
+		properties: map[string]string{
+			"Arn":                "MyBucket.Arn",
+			"DomainName":         "MyBucket.DomainName",
+			"RegionalDomainName": "MyBucket.RegionalDomainName",
+		},
+	},
+	{
+		resourceName: "MyEventBus",
+		resource: &testAWSResource{
+			resourceType: "AWS::Events::EventBus",
+		},
+		properties: map[string]string{
+			"Arn":  "MyEventBus.Arn",
+			"Name": "MyEventBus.Name",
+		},
+	},
+	{
+		resourceName: "MyDBCluster",
+		resource:     &gocf.RDSDBCluster{},
+		properties: map[string]string{
+			"Endpoint.Address":     "MyDBCluster.Endpoint.Address",
+			"Endpoint.Port":        "MyDBCluster.Endpoint.Port",
+			"ReadEndpoint.Address": "MyDBCluster.ReadEndpoint.Address",
+		},
+	},
+}
+
+func TestDiscoveryResourceProperties(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	for _, eachTest := range discoveryPropertiesTests {
+		template := gocf.NewTemplate()
+		template.AddResource(eachTest.resourceName, eachTest.resource)
+		discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template,
+			eachTest.resourceName,
+			&discoveryOptions{strict: true},
+			logger)
+		if discoveryDataErr != nil {
+			t.Fatalf("Failed to create %s discovery data: %s", eachTest.resourceName, discoveryDataErr)
+		}
+		resource := resolveDiscoveryResource(t, discoveryData)
+		if resource.ResourceRef != fmt.Sprintf("physical-%s", eachTest.resourceName) ||
+			resource.ResourceType != resourcePropertiesValue(eachTest.resource).CfnResourceType() {
+			t.Errorf("Unexpected %s discovery resource: %#v", eachTest.resourceName, resource)
+		}
+		if !reflect.DeepEqual(resource.Properties, eachTest.properties) {
+			t.Errorf("Unexpected %s properties: %#v", eachTest.resourceName, resource.Properties)
+		}
+	}
+}
+
+func TestDiscoveryResourceInfoResolvesToJSON(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyTopic", &gocf.SNSTopic{})
+
+	discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template,
+		"MyTopic",
+		nil,
+		logger)
+	if discoveryDataErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", discoveryDataErr)
+	}
+	resource := resolveDiscoveryResource(t, discoveryData)
+	if resource.ResourceRef != "physical-MyTopic" {
+		t.Errorf("Unexpected ResourceRef value: %s", resource.ResourceRef)
+	}
+	if resource.Properties["TopicName"] != "MyTopic.TopicName" {
+		t.Errorf("Unexpected TopicName property: %#v", resource.Properties)
+	}
+}
+
+func TestDiscoveryInfoResourceRefResolves(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+
+	dependencyText, dependencyTextErr := discoveryInfoForDependencies(template,
+		[]string{"MyQueue"},
+		nil,
+		logger)
+	if dependencyTextErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", dependencyTextErr)
+	}
+	discoveryInfo, discoveryInfoErr := discoveryInfoForResource("MyFunction", dependencyText)
+	if discoveryInfoErr != nil {
+		t.Fatalf("Failed to create discovery info: %s", discoveryInfoErr)
+	}
+	discoveryInfoData := resolveDiscoveryInfo(t, discoveryInfo)
+	queueResource, queueResourceOk := discoveryInfoData.Resources["MyQueue"]
+	if !queueResourceOk || queueResource.ResourceRef != "physical-MyQueue" {
+		t.Errorf("Unexpected ResourceRef value: %#v", discoveryInfoData.Resources)
+	}
+}
+
+func TestDiscoveryDataValidation(t *testing.T) {
+	validData := `{ "ResourceRef" : "{"Ref":"MyResource"}" }`
+	if err := validateDiscoveryData("MyResource", []byte(validData)); err != nil {
+		t.Errorf("Failed to validate discovery data: %s", err)
+	}
+	invalidData := `{ "ResourceRef" : {"Ref":"MyResource"} }`
+	if err := validateDiscoveryData("MyResource", []byte(invalidData)); err == nil {
+		t.Errorf("Failed to reject unquoted discovery data expression")
+	}
+}
+
+func TestSafeMergeTemplatesStrategy(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	newTemplates := func() (*gocf.Template, *gocf.Template) {
+		sourceTemplate := gocf.NewTemplate()
+		sourceTemplate.AddResource("Shared", &gocf.SQSQueue{})
+		destTemplate := gocf.NewTemplate()
+		destTemplate.AddResource("Shared", &gocf.SNSTopic{})
+		return sourceTemplate, destTemplate
+	}
+	sourceTemplate, destTemplate := newTemplates()
+	mergeErr := safeMergeTemplates(sourceTemplate, destTemplate, logger)
+	templateMergeErr, templateMergeErrOk := mergeErr.(*TemplateMergeError)
+	if !templateMergeErrOk {
+		t.Fatalf("Failed to reject duplicate resource name: %#v", mergeErr)
+	}
+	if len(templateMergeErr.Conflicts) != 1 ||
+		templateMergeErr.Conflicts[0].Section != "Resources" ||
+		templateMergeErr.Conflicts[0].Name != "Shared" {
+		t.Errorf("Unexpected merge conflicts: %#v", templateMergeErr.Conflicts)
+	}
+
+	sourceTemplate, destTemplate = newTemplates()
+	mergeErr = safeMergeTemplatesWithOptions(sourceTemplate,
+		destTemplate,
+		&TemplateMergeOptions{Strategy: TemplateMergePreferSource},
+		logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge with PreferSource: %s", mergeErr)
+	}
+	if destTemplate.Resources["Shared"].Properties.CfnResourceType() != "AWS::SQS::Queue" {
+		t.Errorf("Failed to replace destination resource with PreferSource")
+	}
+
+	sourceTemplate, destTemplate = newTemplates()
+	mergeErr = safeMergeTemplatesWithOptions(sourceTemplate,
+		destTemplate,
+		&TemplateMergeOptions{Strategy: TemplateMergePreferDest},
+		logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge with PreferDest: %s", mergeErr)
+	}
+	if destTemplate.Resources["Shared"].Properties.CfnResourceType() != "AWS::SNS::Topic" {
+		t.Errorf("Failed to preserve destination resource with PreferDest")
+	}
+}
+
+func TestSafeMergeTemplatesDecoratorOptions(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	exportTemplate := func(mergeOptions *TemplateMergeOptions) (*gocf.Template, error) {
+		template := gocf.NewTemplate()
+		template.AddResource("SharedTopic", &gocf.SNSTopic{
+			DisplayName: gocf.String("Dest"),
+		})
+		lambdaFn := HandleAWSLambda("MyFunction", nil, "MyRole")
+		lambdaFn.DecoratorMergeOptions = mergeOptions
+		lambdaFn.Decorator = func(serviceName string,
+			lambdaResourceName string,
+			lambdaResource gocf.LambdaFunction,
+			resourceMetadata map[string]interface{},
+			S3Bucket string,
+			S3Key string,
+			buildID string,
+			template *gocf.Template,
+			context map[string]interface{},
+			logger *logrus.Logger) error {
+			template.AddResource("SharedTopic", &gocf.SNSTopic{
+				DisplayName: gocf.String("Source"),
+			})
+			return nil
+		}
+		exportErr := lambdaFn.export("MyService",
+			false,
+			"go1.x",
+			"MyBucket",
+			"MyKey",
+			"",
+			"MyBuildID",
+			map[string]*gocf.StringExpr{"MyRole": gocf.String("MyRoleArn")},
+			template,
+			nil,
+			logger)
+		return template, exportErr
+	}
+	_, exportErr := exportTemplate(nil)
+	if exportErr == nil {
+		t.Errorf("Failed to reject conflicting decorator resource")
+	}
+	template, exportErr := exportTemplate(&TemplateMergeOptions{
+		Strategy: TemplateMergePreferSource,
+	})
+	if exportErr != nil {
+		t.Fatalf("Failed to merge decorator template with options: %s", exportErr)
+	}
+	topic := template.Resources["SharedTopic"].Properties.(*gocf.SNSTopic)
+	if topic.DisplayName.Literal != "Source" {
+		t.Errorf("Unexpected merged decorator resource: %#v", topic)
+	}
+}
+
+func TestSafeMergeTemplatesPrefix(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	sourceTemplate := gocf.NewTemplate()
+	sourceTemplate.AddResource("Queue", &gocf.SQSQueue{})
+	policyResource := sourceTemplate.AddResource("Policy", &gocf.SQSQueuePolicy{
+		Queues: gocf.StringList(gocf.Ref("Queue")),
+	})
+	policyResource.DependsOn = []string{"Queue"}
+	sourceTemplate.Outputs["QueueArn"] = &gocf.Output{
+		Value: gocf.GetAtt("Queue", "Arn"),
+	}
+	destTemplate := gocf.NewTemplate()
+	destTemplate.AddResource("Queue", &gocf.SQSQueue{})
+
+	mergeErr := safeMergeTemplatesWithOptions(sourceTemplate,
+		destTemplate,
+		&TemplateMergeOptions{Prefix: "Module"},
+		logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge prefixed template: %s", mergeErr)
+	}
+	if len(destTemplate.Resources) != 3 {
+		t.Fatalf("Unexpected merged resources: %#v", destTemplate.Resources)
+	}
+	modulePolicy, modulePolicyOk := destTemplate.Resources["ModulePolicy"]
+	if !modulePolicyOk {
+		t.Fatalf("Failed to prefix source resource name")
+	}
+	if len(modulePolicy.DependsOn) != 1 || modulePolicy.DependsOn[0] != "ModuleQueue" {
+		t.Errorf("Failed to prefix DependsOn: %#v", modulePolicy.DependsOn)
+	}
+	policyJSON, _ := json.Marshal(modulePolicy.Properties)
+	if !bytes.Contains(policyJSON, []byte(`{"Ref":"ModuleQueue"}`)) {
+		t.Errorf("Failed to prefix Ref: %s", string(policyJSON))
+	}
+	outputJSON, _ := json.Marshal(destTemplate.Outputs["ModuleQueueArn"])
+	if !bytes.Contains(outputJSON, []byte(`"ModuleQueue"`)) {
+		t.Errorf("Failed to prefix Fn::GetAtt: %s", string(outputJSON))
+	}
+	if _, sourceQueueOk := sourceTemplate.Resources["Queue"]; !sourceQueueOk {
+		t.Errorf("Source template was modified by prefix")
+	}
+}
+
+func TestSafeMergeTemplatesPrefixTypes(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	sourceTemplate := gocf.NewTemplate()
+	sourceTemplate.AddResource("Queue", &gocf.SQSQueue{})
+	sourceTemplate.AddResource("Stack", &NestedStack{
+		CloudFormationStack: gocf.CloudFormationStack{
+			TemplateURL: gocf.String("https://example.com/template.json"),
+		},
+		Outputs: []string{"TableName"},
+	})
+	sourceEnvironment := map[string]*gocf.StringExpr{
+		"QUEUE_URL":  gocf.Ref("Queue").String(),
+		"TABLE_NAME": gocf.GetAtt("Stack", "Outputs.TableName"),
+	}
+	functionResource := sourceTemplate.AddResource("Function", &gocf.LambdaFunction{
+		Environment: &gocf.LambdaFunctionEnvironment{
+			Variables: sourceEnvironment,
+		},
+	})
+	functionResource.Metadata = map[string]interface{}{
+		"Queue": map[string]interface{}{
+			"Ref": "Queue",
+		},
+	}
+	destTemplate := gocf.NewTemplate()
+
+	mergeErr := safeMergeTemplatesWithOptions(sourceTemplate,
+		destTemplate,
+		&TemplateMergeOptions{Prefix: "Module"},
+		logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge prefixed template: %s", mergeErr)
+	}
+	moduleStack, moduleStackOk := destTemplate.Resources["ModuleStack"].Properties.(*NestedStack)
+	if !moduleStackOk {
+		t.Fatalf("Unexpected prefixed NestedStack type: %T", destTemplate.Resources["ModuleStack"].Properties)
+	}
+	if !reflect.DeepEqual(moduleStack.Outputs, []string{"TableName"}) {
+		t.Errorf("Failed to preserve NestedStack Outputs: %#v", moduleStack.Outputs)
+	}
+	moduleFunction, moduleFunctionOk := destTemplate.Resources["ModuleFunction"].Properties.(*gocf.LambdaFunction)
+	if !moduleFunctionOk {
+		t.Fatalf("Unexpected prefixed LambdaFunction type: %T", destTemplate.Resources["ModuleFunction"].Properties)
+	}
+	moduleEnvironment, moduleEnvironmentOk := moduleFunction.Environment.Variables.(map[string]*gocf.StringExpr)
+	if !moduleEnvironmentOk {
+		t.Fatalf("Unexpected prefixed Environment Variables type: %T", moduleFunction.Environment.Variables)
+	}
+	environmentJSON, _ := json.Marshal(moduleEnvironment)
+	if !bytes.Contains(environmentJSON, []byte(`{"Ref":"ModuleQueue"}`)) ||
+		!bytes.Contains(environmentJSON, []byte(`"ModuleStack"`)) {
+		t.Errorf("Failed to prefix Environment references: %s", string(environmentJSON))
+	}
+	metadataJSON, _ := json.Marshal(destTemplate.Resources["ModuleFunction"].Metadata)
+	if !bytes.Contains(metadataJSON, []byte(`{"Ref":"ModuleQueue"}`)) {
+		t.Errorf("Failed to prefix Metadata references: %s", string(metadataJSON))
+	}
+	sourceJSON, _ := json.Marshal(sourceEnvironment)
+	if !bytes.Contains(sourceJSON, []byte(`{"Ref":"Queue"}`)) ||
+		functionResource.Metadata["Queue"].(map[string]interface{})["Ref"] != "Queue" {
+		t.Errorf("Source template was modified by prefix: %s", string(sourceJSON))
+	}
+}
+
+func TestSafeAppendDependency(t *testing.T) {
+	resource := &gocf.Resource{}
+	safeAppendDependency(resource, "MyDependency")
+	safeAppendDependency(resource, "MyDependency")
+	if len(resource.DependsOn) != 1 {
+		t.Errorf("Failed to deduplicate DependsOn: %#v", resource.DependsOn)
+	}
+}
+
+func TestSafeRemoveDependency(t *testing.T) {
+	resource := &gocf.Resource{
+		DependsOn: []string{"MyDependency", "OtherDependency", "MyDependency"},
+	}
+	safeRemoveDependency(resource, "MissingDependency")
+	if len(resource.DependsOn) != 3 {
+		t.Errorf("Unexpected DependsOn after removing missing name: %#v", resource.DependsOn)
+	}
+	safeRemoveDependency(resource, "MyDependency")
+	if len(resource.DependsOn) != 1 || resource.DependsOn[0] != "OtherDependency" {
+		t.Errorf("Failed to remove dependency: %#v", resource.DependsOn)
+	}
+	safeRemoveDependency(resource, "OtherDependency")
+	if resource.DependsOn != nil {
+		t.Errorf("Failed to reset empty DependsOn: %#v", resource.DependsOn)
+	}
+}
+
+func TestSafeRemoveDanglingReferences(t *testing.T) {
+	logger, _ := NewLogger("fatal")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	template.AddResource("MyTopic", &gocf.SNSTopic{})
+
+	dependencyText, dependencyTextErr := discoveryInfoForDependencies(template,
+		[]string{"MyTopic"},
+		nil,
+		logger)
+	if dependencyTextErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", dependencyTextErr)
+	}
+	discoveryInfo, discoveryInfoErr := discoveryInfoForResource("MyFunction", dependencyText)
+	if discoveryInfoErr != nil {
+		t.Fatalf("Failed to create discovery info: %s", discoveryInfoErr)
+	}
+	environmentVars := map[string]*gocf.StringExpr{
+		spartaEnvVarDiscoveryInformation: discoveryInfo,
+		"MY_VALUE":                       gocf.String("value"),
+	}
+	functionResource := template.AddResource("MyFunction", &gocf.LambdaFunction{
+		Environment: &gocf.LambdaFunctionEnvironment{
+			Variables: environmentVars,
+		},
+	})
+	functionResource.DependsOn = []string{"MyQueue", "MyTopic"}
+
+	// Nothing is removed while the dependencies exist
+	removedReferences, removedReferencesErr := RemoveDanglingReferences(template, logger)
+	if removedReferencesErr != nil || len(removedReferences) != 0 {
+		t.Fatalf("Unexpected removed references: %#v (%v)", removedReferences, removedReferencesErr)
+	}
+
+	delete(template.Resources, "MyTopic")
+	removedReferences, removedReferencesErr = RemoveDanglingReferences(template, logger)
+	if removedReferencesErr != nil {
+		t.Fatalf("Failed to remove dangling references: %s", removedReferencesErr)
+	}
+	expectedReferences := []DanglingReference{
+		{ResourceName: "MyFunction", Reference: "MyTopic", Source: "DependsOn"},
+		{ResourceName: "MyFunction", Reference: "MyTopic", Source: spartaEnvVarDiscoveryInformation},
+	}
+	if !reflect.DeepEqual(removedReferences, expectedReferences) {
+		t.Errorf("Unexpected removed references: %#v", removedReferences)
+	}
+	if !reflect.DeepEqual(functionResource.DependsOn, []string{"MyQueue"}) {
+		t.Errorf("Unexpected DependsOn value: %#v", functionResource.DependsOn)
+	}
+	if _, discoveryOk := environmentVars[spartaEnvVarDiscoveryInformation]; discoveryOk ||
+		len(environmentVars) != 1 {
+		t.Errorf("Unexpected environment variables: %#v", environmentVars)
+	}
+}
+
+func TestSafeMetadataMerge(t *testing.T) {
+	resource := &gocf.Resource{}
+	safeMetadataMerge(resource, "AWS::CloudFormation::Init", map[string]interface{}{
+		"configSets": map[string]interface{}{
+			"default": []string{"first"},
+		},
+		"first": "value",
+	})
+	safeMetadataMerge(resource, "AWS::CloudFormation::Init", map[string]interface{}{
+		"configSets": map[string]interface{}{
+			"extra": []string{"second"},
+		},
+		"first": "replaced",
+	})
+	initMetadata := resource.Metadata["AWS::CloudFormation::Init"].(map[string]interface{})
+	configSets := initMetadata["configSets"].(map[string]interface{})
+	if len(configSets) != 2 {
+		t.Errorf("Failed to merge nested metadata: %#v", configSets)
+	}
+	if initMetadata["first"] != "replaced" {
+		t.Errorf("Failed to overwrite non-map metadata value: %#v", initMetadata)
+	}
+}
+
+type testDiscoveryCustomResource struct {
+	gocf.CloudFormationCustomResource
+}
+
+func (resource testDiscoveryCustomResource) CfnResourceType() string {
+	return "Custom::SpartaTestDiscoveryResource"
+}
+
+func TestRegisterResourceOutputs(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	RegisterResourceOutputs("Custom::SpartaTestDiscoveryResource",
+		func(resource gocf.ResourceProperties) []string {
+			return []string{"Endpoint"}
+		})
+	outputs, outputsErr := resourceOutputs("MyResource",
+		&testDiscoveryCustomResource{},
+		true,
+		logger)
+	if outputsErr != nil {
+		t.Fatalf("Failed to use registered resource outputs: %s", outputsErr)
+	}
+	if len(outputs) != 1 || outputs[0] != "Endpoint" {
+		t.Errorf("Unexpected registered resource outputs: %#v", outputs)
+	}
+}
+
+func TestRegisterResourceOutputsPointerResource(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	valueOutputs := func(resource gocf.ResourceProperties) []string {
+		if _, resourceOk := resource.(testAWSResource); !resourceOk {
+			return []string{"Pointer"}
+		}
+		return []string{"Value"}
+	}
+	RegisterResourceOutputs("Custom::SpartaRegisteredPointerResource", valueOutputs)
+	OverrideResourceOutputs("Custom::SpartaOverriddenPointerResource", valueOutputs)
+	for _, eachType := range []string{"Custom::SpartaRegisteredPointerResource",
+		"Custom::SpartaOverriddenPointerResource"} {
+		for _, eachResource := range []gocf.ResourceProperties{
+			testAWSResource{resourceType: eachType},
+			&testAWSResource{resourceType: eachType},
+		} {
+			outputs, outputsErr := resourceOutputs("MyResource", eachResource, true, logger)
+			if outputsErr != nil {
+				t.Fatalf("Failed to get %s outputs: %s", eachType, outputsErr)
+			}
+			if !reflect.DeepEqual(outputs, []string{"Value"}) {
+				t.Errorf("Unexpected %s outputs for %T: %#v", eachType, eachResource, outputs)
+			}
+		}
+	}
+}
+
+func TestNewCloudFormationResourceUnsupportedType(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	resource, resourceErr := newCloudFormationResource("Custom::SpartaUnsupportedType", logger)
+	if resourceErr == nil || resource != nil {
+		t.Errorf("Failed to return error for unsupported resource type")
+	}
+}
+
+func TestDiscoveryValidationReport(t *testing.T) {
+	logger, _ := NewLogger("error")
+	template := gocf.NewTemplate()
+	template.AddResource("MyTopic", &gocf.SNSTopic{})
+	template.AddResource("MyAttachment", &gocf.EC2VolumeAttachment{})
+	template.AddResource("MyVolume", &gocf.EC2Volume{})
+
+	validationResults := ValidateDiscoveryInfo(template, logger)
+	if len(validationResults) != 2 {
+		t.Fatalf("Unexpected validation results: %#v", validationResults)
+	}
+	if validationResults[0].ResourceName != "MyAttachment" ||
+		validationResults[0].ResourceType != "AWS::EC2::VolumeAttachment" {
+		t.Errorf("Unexpected validation result: %#v", validationResults[0])
+	}
+	if validationResults[1].ResourceName != "MyVolume" ||
+		validationResults[1].ResourceType != "AWS::EC2::Volume" {
+		t.Errorf("Unexpected validation result: %#v", validationResults[1])
+	}
+}
+
+func TestResourceOutputsElastiCache(t *testing.T) {
+	logger, _ := NewLogger("fatal")
+	outputs, _ := resourceOutputs("MyCluster", &gocf.ElastiCacheCacheCluster{
+		Engine: gocf.String("redis"),
+	}, true, logger)
+	if len(outputs) != 2 || outputs[0] != "RedisEndpoint.Address" {
+		t.Errorf("Unexpected redis cluster outputs: %#v", outputs)
+	}
+	outputs, _ = resourceOutputs("MyCluster", &gocf.ElastiCacheCacheCluster{
+		Engine: gocf.String("memcached"),
+	}, true, logger)
+	if len(outputs) != 2 || outputs[0] != "ConfigurationEndpoint.Address" {
+		t.Errorf("Unexpected memcached cluster outputs: %#v", outputs)
+	}
+	_, outputsErr := resourceOutputs("MyCluster", &gocf.ElastiCacheCacheCluster{
+		Engine: gocf.Ref("EngineParam").String(),
+	}, true, logger)
+	if outputsErr == nil {
+		t.Errorf("Failed to reject non-literal Engine value in strict mode")
+	}
+	outputs, outputsErr = resourceOutputs("MyCluster", &gocf.ElastiCacheCacheCluster{
+		Engine: gocf.Ref("EngineParam").String(),
+	}, false, logger)
+	if outputsErr != nil || len(outputs) != 0 {
+		t.Errorf("Unexpected non-literal Engine outputs: %#v (%v)", outputs, outputsErr)
+	}
+	outputs, _ = resourceOutputs("MyGroup", &gocf.ElastiCacheReplicationGroup{}, true, logger)
+	if len(outputs) != 2 || outputs[0] != "PrimaryEndPoint.Address" {
+		t.Errorf("Unexpected replication group outputs: %#v", outputs)
+	}
+}
+
+func TestSafeMergeTemplatesDescription(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	mergedDescription := func(policy TemplateMergeDescriptionPolicy) string {
+		sourceTemplate := gocf.NewTemplate()
+		sourceTemplate.Description = "Source"
+		destTemplate := gocf.NewTemplate()
+		destTemplate.Description = "Dest"
+		mergeErr := safeMergeTemplatesWithOptions(sourceTemplate,
+			destTemplate,
+			&TemplateMergeOptions{DescriptionPolicy: policy},
+			logger)
+		if mergeErr != nil {
+			t.Fatalf("Failed to merge templates: %s", mergeErr)
+		}
+		return destTemplate.Description
+	}
+	if description := mergedDescription(TemplateMergeDescriptionPreserve); description != "Dest" {
+		t.Errorf("Unexpected preserved Description: %s", description)
+	}
+	if description := mergedDescription(TemplateMergeDescriptionReplace); description != "Source" {
+		t.Errorf("Unexpected replaced Description: %s", description)
+	}
+	if description := mergedDescription(TemplateMergeDescriptionAppend); description != "Dest Source" {
+		t.Errorf("Unexpected appended Description: %s", description)
+	}
+}
+
+func TestSafeMergeTemplatesSummary(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	sourceTemplate := gocf.NewTemplate()
+	sourceTemplate.AddResource("Queue", &gocf.SQSQueue{})
+	sourceTemplate.AddResource("Topic", &gocf.SNSTopic{})
+	sourceTemplate.Outputs["QueueArn"] = &gocf.Output{
+		Value: gocf.GetAtt("Queue", "Arn"),
+	}
+	destTemplate := gocf.NewTemplate()
+	destTemplate.AddResource("Bucket", &gocf.S3Bucket{})
+
+	summary, mergeErr := safeMergeTemplatesWithSummary(sourceTemplate,
+		destTemplate,
+		nil,
+		logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge templates: %s", mergeErr)
+	}
+	if len(summary.Resources) != 2 ||
+		summary.Resources[0] != "Queue" ||
+		summary.Resources[1] != "Topic" {
+		t.Errorf("Unexpected merged resources: %#v", summary.Resources)
+	}
+	if len(summary.Outputs) != 1 || summary.Outputs[0] != "QueueArn" {
+		t.Errorf("Unexpected merged outputs: %#v", summary.Outputs)
+	}
+	if len(summary.Mappings) != 0 {
+		t.Errorf("Unexpected merged mappings: %#v", summary.Mappings)
+	}
+}
+
+func TestDiscoveryUndiscoverableResources(t *testing.T) {
+	template := gocf.NewTemplate()
+	template.AddResource("MyTopic", &gocf.SNSTopic{})
+	template.AddResource("MyVolume", &gocf.EC2Volume{})
+
+	unsupportedResources := UndiscoverableResources(template)
+	if len(unsupportedResources) != 1 ||
+		unsupportedResources["MyVolume"] != "AWS::EC2::Volume" {
+		t.Errorf("Unexpected undiscoverable resources: %#v", unsupportedResources)
+	}
+}
+
+func TestDiscoveryTemplateAttributes(t *testing.T) {
+	template := gocf.NewTemplate()
+	template.AddResource("MyTopic", &gocf.SNSTopic{})
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	template.AddResource("MyVolume", &gocf.EC2Volume{})
+
+	// Unsupported resources are skipped, even when discovery is strict,
+	// and aren't reported to the UnsupportedResourceHandler
+	StrictDiscovery = true
+	unsupportedNames := []string{}
+	UnsupportedResourceHandler = func(resourceName string, resourceType string) {
+		unsupportedNames = append(unsupportedNames, resourceName)
+	}
+	defer func() {
+		StrictDiscovery = false
+		UnsupportedResourceHandler = nil
+	}()
+	attributes := DiscoveryAttributes(template)
+	if len(unsupportedNames) != 0 {
+		t.Errorf("Unexpected UnsupportedResourceHandler calls: %#v", unsupportedNames)
+	}
+	expected := []DiscoveryAttribute{
+		{ResourceName: "MyQueue", Attribute: "Arn"},
+		{ResourceName: "MyQueue", Attribute: "QueueName"},
+		{ResourceName: "MyTopic", Attribute: "TopicName"},
+	}
+	if !reflect.DeepEqual(attributes, expected) {
+		t.Errorf("Unexpected discovery attributes: %#v", attributes)
+	}
+}
+
+func TestSafeMergeTemplatesReferences(t *testing.T) {
+	logger, _ := NewLogger("fatal")
+	sourceTemplate := gocf.NewTemplate()
+	sourceTemplate.AddResource("Queue", &gocf.SQSQueue{})
+	sourceTemplate.AddResource("Policy", &gocf.SQSQueuePolicy{
+		Queues: gocf.StringList(gocf.Ref("Queue"), gocf.Ref("MissingQueue")),
+	})
+	destTemplate := gocf.NewTemplate()
+	destTemplate.AddResource("Queue", &gocf.SNSTopic{})
+
+	mergeErr := safeMergeTemplatesWithOptions(sourceTemplate,
+		destTemplate,
+		&TemplateMergeOptions{
+			Strategy:        TemplateMergePreferDest,
+			CheckReferences: true,
+		},
+		logger)
+	templateMergeErr, templateMergeErrOk := mergeErr.(*TemplateMergeError)
+	if !templateMergeErrOk {
+		t.Fatalf("Failed to reject inconsistent references: %#v", mergeErr)
+	}
+	if len(templateMergeErr.References) != 2 ||
+		templateMergeErr.References[0].Target != "MissingQueue" ||
+		templateMergeErr.References[1].Target != "Queue" {
+		t.Errorf("Unexpected reference mismatches: %#v", templateMergeErr.References)
+	}
+}
+
+func TestSafeMergeTemplatesIdenticalDefinitions(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	newTemplate := func() *gocf.Template {
+		template := gocf.NewTemplate()
+		template.AddResource("Queue", &gocf.SQSQueue{})
+		template.Outputs["QueueArn"] = &gocf.Output{
+			Value: gocf.GetAtt("Queue", "Arn"),
+		}
+		return template
+	}
+	mergeErr := safeMergeTemplates(newTemplate(), newTemplate(), logger)
+	if mergeErr != nil {
+		t.Errorf("Failed to merge identical definitions: %s", mergeErr)
+	}
+}
+
+func TestSafeMergeTemplatesEquivalentDefinitions(t *testing.T) {
+	logger, _ := NewLogger("fatal")
+	sourceTemplate := gocf.NewTemplate()
+	sourceTemplate.AddResource("LogGroup", &gocf.LogsLogGroup{
+		RetentionInDays: gocf.Integer(7),
+	})
+	sourceTemplate.AddResource("Topic", &gocf.SNSTopic{
+		DisplayName: gocf.String("Source"),
+	})
+	destTemplate := gocf.NewTemplate()
+	destTemplate.AddResource("LogGroup", gocf.LogsLogGroup{
+		RetentionInDays: gocf.Integer(7),
+	})
+	destTemplate.AddResource("Topic", &gocf.SNSTopic{
+		DisplayName: gocf.String("Dest"),
+	})
+
+	mergeErr := safeMergeTemplates(sourceTemplate, destTemplate, logger)
+	templateMergeErr, templateMergeErrOk := mergeErr.(*TemplateMergeError)
+	if !templateMergeErrOk {
+		t.Fatalf("Failed to reject different definitions: %#v", mergeErr)
+	}
+	if len(templateMergeErr.Conflicts) != 1 ||
+		templateMergeErr.Conflicts[0].Name != "Topic" {
+		t.Errorf("Unexpected merge conflicts: %#v", templateMergeErr.Conflicts)
+	}
+}
+
+func TestSafeMergeTemplatesParameters(t *testing.T) {
+	logger, _ := NewLogger("fatal")
+	sourceTemplate := gocf.NewTemplate()
+	sourceTemplate.Parameters["Stage"] = &gocf.Parameter{
+		Type:    "String",
+		Default: "dev",
+	}
+	sourceTemplate.Parameters["Retention"] = &gocf.Parameter{
+		Type:    "Number",
+		Default: "7",
+	}
+	destTemplate := gocf.NewTemplate()
+	destTemplate.Parameters["Stage"] = &gocf.Parameter{
+		Type:    "String",
+		Default: "dev",
+	}
+	summary, mergeErr := safeMergeTemplatesWithSummary(sourceTemplate, destTemplate, nil, logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge identical Parameters: %s", mergeErr)
+	}
+	if !reflect.DeepEqual(summary.Parameters, []string{"Retention"}) {
+		t.Errorf("Unexpected merged Parameters: %#v", summary.Parameters)
+	}
+	if len(destTemplate.Parameters) != 2 ||
+		destTemplate.Parameters["Retention"].Default != "7" {
+		t.Errorf("Unexpected destination Parameters: %#v", destTemplate.Parameters)
+	}
+}
+
+func TestSafeMergeTemplatesConditions(t *testing.T) {
+	logger, _ := NewLogger("fatal")
+	newTemplate := func(stage string) *gocf.Template {
+		template := gocf.NewTemplate()
+		template.Conditions["IsProduction"] = map[string]interface{}{
+			"Fn::Equals": []interface{}{gocf.Ref("Stage"), stage},
+		}
+		template.Conditions["HasBucket"] = map[string]interface{}{
+			"Fn::Not": []interface{}{
+				map[string]interface{}{
+					"Fn::Equals": []interface{}{gocf.Ref("BucketName"), ""},
+				},
+			},
+		}
+		return template
+	}
+	mergeErr := safeMergeTemplates(newTemplate("prod"), newTemplate("prod"), logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge identical Conditions: %s", mergeErr)
+	}
+	mergeErr = safeMergeTemplates(newTemplate("prod"), newTemplate("production"), logger)
+	templateMergeErr, templateMergeErrOk := mergeErr.(*TemplateMergeError)
+	if !templateMergeErrOk {
+		t.Fatalf("Failed to reject different Conditions: %#v", mergeErr)
+	}
+	expectedConflicts := []TemplateMergeConflict{
+		{Section: "Conditions", Name: "IsProduction"},
+	}
+	if !reflect.DeepEqual(templateMergeErr.Conflicts, expectedConflicts) {
+		t.Errorf("Unexpected merge conflicts: %#v", templateMergeErr.Conflicts)
+	}
+}
+
+func TestResourceOutputsDAXCluster(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	outputs, outputsErr := resourceOutputs("MyCluster", &gocf.DAXCluster{
+		ClusterName: gocf.String("MyCluster"),
+	}, true, logger)
+	if outputsErr != nil {
+		t.Fatalf("Failed to get DAX outputs: %s", outputsErr)
+	}
+	if !reflect.DeepEqual(outputs, []string{"Arn", "ClusterDiscoveryEndpoint"}) {
+		t.Errorf("Unexpected DAX outputs: %#v", outputs)
+	}
+}
+
+func TestResourceOutputsECRRepository(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	outputs, outputsErr := resourceOutputs("MyRepository", &gocf.ECRRepository{
+		RepositoryName: gocf.String("my-repository"),
+	}, true, logger)
+	if outputsErr != nil {
+		t.Fatalf("Failed to get ECR outputs: %s", outputsErr)
+	}
+	if !reflect.DeepEqual(outputs, []string{"Arn", "RepositoryUri"}) {
+		t.Errorf("Unexpected ECR outputs: %#v", outputs)
+	}
+}
+
+func TestResourceOutputsMSKCluster(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	for _, eachType := range []string{"AWS::MSK::Cluster", "AWS::MSK::ServerlessCluster"} {
+		outputs, outputsErr := resourceOutputs("MyCluster", &testAWSResource{
+			resourceType: eachType,
+		}, true, logger)
+		if outputsErr != nil {
+			t.Fatalf("Failed to get %s outputs: %s", eachType, outputsErr)
+		}
+		if !reflect.DeepEqual(outputs, []string{"Arn"}) {
+			t.Errorf("Unexpected %s outputs: %#v", eachType, outputs)
+		}
+	}
+}
+
+func TestResourceOutputsNeptuneDBCluster(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	outputs, outputsErr := resourceOutputs("MyCluster", &testAWSResource{
+		resourceType: "AWS::Neptune::DBCluster",
+	}, true, logger)
+	if outputsErr != nil {
+		t.Fatalf("Failed to get Neptune outputs: %s", outputsErr)
+	}
+	if !reflect.DeepEqual(outputs, []string{"Endpoint", "Port", "ReadEndpoint"}) {
+		t.Errorf("Unexpected Neptune outputs: %#v", outputs)
+	}
+}
+
+func TestResourceOutputsDynamoDBTable(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	outputs, _ := resourceOutputs("MyTable", &gocf.DynamoDBTable{}, true, logger)
+	if len(outputs) != 1 || outputs[0] != "Arn" {
+		t.Errorf("Unexpected table outputs: %#v", outputs)
+	}
+	outputs, _ = resourceOutputs("MyTable", &gocf.DynamoDBTable{
+		StreamSpecification: &gocf.DynamoDBTableStreamSpecification{
+			StreamViewType: gocf.String("NEW_IMAGE"),
+		},
+	}, true, logger)
+	if len(outputs) != 2 || outputs[1] != "StreamArn" {
+		t.Errorf("Unexpected streaming table outputs: %#v", outputs)
+	}
+	computedOutputs := resourceComputedOutputs("MyTable", &gocf.DynamoDBTable{
+		StreamSpecification: &gocf.DynamoDBTableStreamSpecification{
+			StreamViewType: gocf.String("NEW_IMAGE"),
+		},
+	})
+	if computedOutputs["StreamViewType"] != "NEW_IMAGE" {
+		t.Errorf("Unexpected StreamViewType: %#v", computedOutputs)
+	}
+}
+
+func TestDiscoveryTransform(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	RegisterDiscoveryTransform(func(resourceName string,
+		resourceType string,
+		properties map[string]string) map[string]string {
+		if resourceType != "AWS::SQS::Queue" || resourceName != "MyTransformedQueue" {
+			return nil
+		}
+		return map[string]string{
+			"QueueURI": fmt.Sprintf("sqs://%s", properties["QueueName"]),
+		}
+	})
+	template := gocf.NewTemplate()
+	template.AddResource("MyTransformedQueue", &gocf.SQSQueue{})
+	discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template,
+		"MyTransformedQueue",
+		nil,
+		logger)
+	if discoveryDataErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", discoveryDataErr)
+	}
+	resource := resolveDiscoveryResource(t, discoveryData)
+	if resource.Properties["QueueURI"] != "sqs://MyTransformedQueue.QueueName" {
+		t.Errorf("Unexpected transformed property: %#v", resource.Properties)
+	}
+	if resource.Properties["Arn"] != "MyTransformedQueue.Arn" {
+		t.Errorf("Failed to preserve built-in property: %#v", resource.Properties)
+	}
+}
+
+func TestDiscoveryTransformCopy(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	RegisterDiscoveryTransform(func(resourceName string,
+		resourceType string,
+		properties map[string]string) map[string]string {
+		if resourceName != "MyCopiedQueue" {
+			return nil
+		}
+		delete(properties, "Arn")
+		properties["Unpublished"] = "value"
+		return map[string]string{
+			"Published": "value",
+		}
+	})
+	template := gocf.NewTemplate()
+	template.AddResource("MyCopiedQueue", &gocf.SQSQueue{})
+	discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template,
+		"MyCopiedQueue",
+		nil,
+		logger)
+	if discoveryDataErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", discoveryDataErr)
+	}
+	resource := resolveDiscoveryResource(t, discoveryData)
+	_, unpublishedExists := resource.Properties["Unpublished"]
+	if resource.Properties["Arn"] != "MyCopiedQueue.Arn" ||
+		resource.Properties["Published"] != "value" ||
+		unpublishedExists {
+		t.Errorf("Unexpected transformed properties: %#v", resource.Properties)
+	}
+}
+
+func TestDiscoveryTransformEscaping(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	RegisterDiscoveryTransform(func(resourceName string,
+		resourceType string,
+		properties map[string]string) map[string]string {
+		switch resourceName {
+		case "MyUnescapedQueue":
+			return map[string]string{
+				"Connection": `host="a"`,
+			}
+		case "MyEscapedQueue":
+			return map[string]string{
+				"Connection": `host=\"a\"`,
+			}
+		}
+		return nil
+	})
+	template := gocf.NewTemplate()
+	template.AddResource("MyUnescapedQueue", &gocf.SQSQueue{})
+	template.AddResource("MyEscapedQueue", &gocf.SQSQueue{})
+
+	_, discoveryDataErr := discoveryResourceJSONForDependency(template, "MyUnescapedQueue", nil, logger)
+	if discoveryDataErr == nil {
+		t.Errorf("Failed to reject unescaped transform value")
+	}
+	discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template, "MyEscapedQueue", nil, logger)
+	if discoveryDataErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", discoveryDataErr)
+	}
+	resource := resolveDiscoveryResource(t, discoveryData)
+	if resource.Properties["Connection"] != `host="a"` {
+		t.Errorf("Unexpected transformed property: %#v", resource.Properties)
+	}
+}
+
+func TestDiscoveryPropertyOrder(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	RegisterDiscoveryTransform(func(resourceName string,
+		resourceType string,
+		properties map[string]string) map[string]string {
+		if resourceName != "MyOrderedQueue" {
+			return nil
+		}
+		transformed := make(map[string]string)
+		for i := 0; i != 12; i++ {
+			transformed[fmt.Sprintf("Setting%d", i)] = fmt.Sprintf("%d", i)
+		}
+		return transformed
+	})
+	template := gocf.NewTemplate()
+	template.AddResource("MyOrderedQueue", &gocf.SQSQueue{})
+
+	dependency, dependencyErr := newDiscoveryDependency(template,
+		"MyOrderedQueue",
+		nil,
+		logger)
+	if dependencyErr != nil {
+		t.Fatalf("Failed to create discovery dependency: %s", dependencyErr)
+	}
+	discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template,
+		"MyOrderedQueue",
+		nil,
+		logger)
+	if discoveryDataErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", discoveryDataErr)
+	}
+	resolvedData, resolvedDataErr := resolveDiscoveryData(discoveryData)
+	if resolvedDataErr != nil {
+		t.Fatalf("Failed to resolve discovery data: %s", resolvedDataErr)
+	}
+	// Walk the tokens to collect the Properties keys in document order
+	decoder := json.NewDecoder(bytes.NewReader([]byte(resolvedData)))
+	propertyNames := []string{}
+	depth := 0
+	inProperties := false
+	expectKey := false
+	for {
+		token, tokenErr := decoder.Token()
+		if tokenErr != nil {
+			break
+		}
+		switch typedToken := token.(type) {
+		case json.Delim:
+			if typedToken == '{' {
+				depth++
+				expectKey = true
+			} else if typedToken == '}' {
+				depth--
+				inProperties = false
+			}
+		case string:
+			if expectKey {
+				if depth == 1 && typedToken == "Properties" {
+					inProperties = true
+				} else if depth == 2 && inProperties {
+					propertyNames = append(propertyNames, typedToken)
+				}
+			}
+			expectKey = !expectKey
+		}
+	}
+	if !reflect.DeepEqual(propertyNames, dependency.propertyNames) {
+		t.Errorf("Unexpected property order.\nExpected: %#v\nActual: %#v",
+			dependency.propertyNames,
+			propertyNames)
+	}
+}
+
+func TestResourceOutputsS3Bucket(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	outputs, _ := resourceOutputs("MyBucket", &gocf.S3Bucket{}, true, logger)
+	for _, eachOutput := range outputs {
+		if eachOutput == "WebsiteURL" {
+			t.Errorf("Unexpected WebsiteURL output for bucket without website: %#v", outputs)
+		}
+	}
+	outputs, _ = resourceOutputs("MyBucket", &gocf.S3Bucket{
+		WebsiteConfiguration: &gocf.S3BucketWebsiteConfiguration{
+			IndexDocument: gocf.String("index.html"),
+		},
+	}, true, logger)
+	if len(outputs) == 0 || outputs[len(outputs)-1] != "WebsiteURL" {
+		t.Errorf("Missing WebsiteURL output for website bucket: %#v", outputs)
+	}
+}
+
+type testProviderCustomResource struct {
+	gocf.CloudFormationCustomResource
+}
+
+func TestNewCloudFormationResourceRegisteredProvider(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	const resourceType = "Custom::SpartaRegisteredProviderResource"
+	done := make(chan bool)
+	for i := 0; i != 4; i++ {
+		go func() {
+			RegisterCustomResourceProvider(func(customResourceType string) gocf.ResourceProperties {
+				if customResourceType == resourceType {
+					return &testProviderCustomResource{}
+				}
+				return nil
+			})
+			newCloudFormationResource(resourceType, logger)
+			done <- true
+		}()
+	}
+	for i := 0; i != 4; i++ {
+		<-done
+	}
+	resource, resourceErr := newCloudFormationResource(resourceType, logger)
+	if resourceErr != nil {
+		t.Fatalf("Failed to create registered custom resource: %s", resourceErr)
+	}
+	if _, resourceOk := resource.(*testProviderCustomResource); !resourceOk {
+		t.Errorf("Unexpected registered custom resource: %#v", resource)
+	}
+}
+
+func TestSafeMergeTemplatesPreview(t *testing.T) {
+	sourceTemplate := gocf.NewTemplate()
+	sourceTemplate.AddResource("Shared", &gocf.SQSQueue{})
+	sourceTemplate.AddResource("Identical", &gocf.SNSTopic{})
+	sourceTemplate.AddResource("Unique", &gocf.SNSTopic{})
+	destTemplate := gocf.NewTemplate()
+	destTemplate.AddResource("Shared", &gocf.SNSTopic{})
+	destTemplate.AddResource("Identical", &gocf.SNSTopic{})
+
+	collisions := previewMerge(sourceTemplate, destTemplate)
+	if len(collisions) != 1 ||
+		len(collisions["Resources"]) != 1 ||
+		collisions["Resources"][0] != "Shared" {
+		t.Errorf("Unexpected merge preview: %#v", collisions)
+	}
+	if len(destTemplate.Resources) != 2 {
+		t.Errorf("Merge preview modified destination template: %#v", destTemplate.Resources)
+	}
+}
+
+func TestDiscoveryStaticProperties(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyTopic", &gocf.SNSTopic{})
+	staticValue := `prefix-"quoted" {"Ref":"MyTopic"} {{ .Value }}`
+	discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template,
+		"MyTopic",
+		&discoveryOptions{
+			staticProperties: map[string]string{
+				"TablePrefix": staticValue,
+			},
+		},
+		logger)
+	if discoveryDataErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", discoveryDataErr)
+	}
+	resource := resolveDiscoveryResource(t, discoveryData)
+	if resource.Properties["TablePrefix"] != staticValue {
+		t.Errorf("Unexpected static property: %#v", resource.Properties)
+	}
+}
+
+func TestDiscoveryResourceJSON(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	options := &discoveryOptions{
+		staticProperties: map[string]string{
+			`Quoted"Name`: `Quoted"Value`,
+		},
+	}
+	jsonData, jsonDataErr := discoveryResourceJSONForDependency(template, "MyQueue", options, logger)
+	if jsonDataErr != nil {
+		t.Fatalf("Failed to create JSON discovery data: %s", jsonDataErr)
+	}
+	jsonResource := resolveDiscoveryResource(t, jsonData)
+	if jsonResource.ResourceRef != "physical-MyQueue" ||
+		jsonResource.Properties[`Quoted"Name`] != `Quoted"Value` {
+		t.Errorf("Unexpected JSON discovery data: %#v", jsonResource)
+	}
+}
+
+func TestDiscoveryResourceExpr(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyExprQueue", &gocf.SQSQueue{})
+	options := &discoveryOptions{
+		staticProperties: map[string]string{
+			`Quoted"Name`: `Quoted"Value {"Ref":"MyExprQueue"}`,
+		},
+	}
+	resourceExpr, resourceExprErr := discoveryResourceExprForDependency(template,
+		"MyExprQueue",
+		options,
+		logger)
+	if resourceExprErr != nil {
+		t.Fatalf("Failed to create typed discovery data: %s", resourceExprErr)
+	}
+	if resourceExpr.ResourceID != "MyExprQueue" ||
+		resourceExpr.ResourceType != "AWS::SQS::Queue" {
+		t.Errorf("Unexpected typed discovery data: %#v", resourceExpr)
+	}
+	expectedJSON := map[string]interface{}{
+		`{"Ref":"MyExprQueue"}`: resourceExpr.ResourceRef,
+		`{"Fn::Join":["",[{"Fn::GetAtt":["MyExprQueue","Arn"]}]]}`:      resourceExpr.Properties["Arn"],
+		`{"Fn::Join":["",["Quoted\"Value {\"Ref\":\"MyExprQueue\"}"]]}`: resourceExpr.Properties[`Quoted"Name`],
+	}
+	for eachExpected, eachValue := range expectedJSON {
+		valueJSON, _ := json.Marshal(eachValue)
+		if string(valueJSON) != eachExpected {
+			t.Errorf("Unexpected typed discovery value. Expected: %s, Actual: %s",
+				eachExpected,
+				valueJSON)
+		}
+	}
+}
+
+func TestDiscoveryResourceInfoFIFOTopic(t *testing.T) {
+	standardOutputs := resourceComputedOutputs("MyTopic", &gocf.SNSTopic{
+		TopicName: gocf.String("MyTopic"),
+	})
+	if _, fifoOk := standardOutputs["FifoTopic"]; fifoOk {
+		t.Errorf("Unexpected FifoTopic output for standard topic: %#v", standardOutputs)
+	}
+	fifoOutputs := resourceComputedOutputs("MyTopic", &gocf.SNSTopic{
+		TopicName: gocf.String("MyTopic.fifo"),
+	})
+	if fifoOutputs["FifoTopic"] != "true" {
+		t.Errorf("Missing FifoTopic output for FIFO topic: %#v", fifoOutputs)
+	}
+}
+
+func TestSafeMergeTemplatesDiff(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	sourceTemplate := gocf.NewTemplate()
+	sourceTemplate.AddResource("Queue", &gocf.SQSQueue{})
+	sourceTemplate.AddResource("Shared", &gocf.SQSQueue{})
+	destTemplate := gocf.NewTemplate()
+	destTemplate.AddResource("Shared", &gocf.SNSTopic{})
+	destTemplate.AddResource("Bucket", &gocf.S3Bucket{})
+
+	beforeTemplate := templateSnapshot(destTemplate)
+	mergeErr := safeMergeTemplatesWithOptions(sourceTemplate,
+		destTemplate,
+		&TemplateMergeOptions{Strategy: TemplateMergePreferSource},
+		logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge templates: %s", mergeErr)
+	}
+	templateDiff := diffTemplates(beforeTemplate, destTemplate)
+	resourcesDiff, resourcesDiffOk := templateDiff["Resources"]
+	if len(templateDiff) != 1 || !resourcesDiffOk {
+		t.Fatalf("Unexpected template diff: %#v", templateDiff)
+	}
+	if len(resourcesDiff.Added) != 1 || resourcesDiff.Added[0] != "Queue" {
+		t.Errorf("Unexpected added resources: %#v", resourcesDiff.Added)
+	}
+	if len(resourcesDiff.Changed) != 1 || resourcesDiff.Changed[0] != "Shared" {
+		t.Errorf("Unexpected changed resources: %#v", resourcesDiff.Changed)
+	}
+}
+
+func TestDiscoveryResourceInfoNoProperties(t *testing.T) {
+	logger, _ := NewLogger("error")
+	template := gocf.NewTemplate()
+	template.AddResource("MyVolume", &gocf.EC2Volume{})
+	discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template, "MyVolume", nil, logger)
+	if discoveryDataErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", discoveryDataErr)
+	}
+	resource := resolveDiscoveryResource(t, discoveryData)
+	if len(resource.Properties) != 0 {
+		t.Errorf("Unexpected discovery properties: %#v", resource.Properties)
+	}
+}
+
+type testDiscoverableCustomResource struct {
+	gocf.CloudFormationCustomResource
+}
+
+func (resource *testDiscoverableCustomResource) DiscoverableOutputs() []string {
+	return []string{"Endpoint", "Port"}
+}
+
+func TestResourceOutputsDiscoverableResource(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	outputs, outputsErr := resourceOutputs("MyResource",
+		&testDiscoverableCustomResource{},
+		true,
+		logger)
+	if outputsErr != nil {
+		t.Fatalf("Failed to use DiscoverableResource outputs: %s", outputsErr)
+	}
+	if len(outputs) != 2 || outputs[0] != "Endpoint" {
+		t.Errorf("Unexpected DiscoverableResource outputs: %#v", outputs)
+	}
+}
+
+func TestResourceOutputsPointerResource(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	valueOutputs, valueOutputsErr := resourceOutputs("MyRule",
+		gocf.EventsRule{},
+		true,
+		logger)
+	if valueOutputsErr != nil {
+		t.Fatalf("Failed to get value resource outputs: %s", valueOutputsErr)
+	}
+	pointerOutputs, pointerOutputsErr := resourceOutputs("MyRule",
+		&gocf.EventsRule{},
+		true,
+		logger)
+	if pointerOutputsErr != nil {
+		t.Fatalf("Failed to get pointer resource outputs: %s", pointerOutputsErr)
+	}
+	if len(pointerOutputs) == 0 || !reflect.DeepEqual(valueOutputs, pointerOutputs) {
+		t.Errorf("Unexpected pointer resource outputs: %#v != %#v", pointerOutputs, valueOutputs)
+	}
+
+	template := gocf.NewTemplate()
+	template.AddResource("MyRule", (*gocf.EventsRule)(nil))
+	_, discoveryErr := discoveryResourceJSONForDependency(template, "MyRule", nil, logger)
+	if discoveryErr == nil {
+		t.Errorf("Failed to reject resource without Properties")
+	}
+}
+
+func TestDiscoveryInfoForDependencies(t *testing.T) {
+	logger, _ := NewLogger("error")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	template.AddResource("MyVolume", &gocf.EC2Volume{})
+
+	discoveryData, discoveryDataErr := discoveryInfoForDependencies(template,
+		[]string{"MyVolume", "MyQueue", "MissingResource"},
+		nil,
+		logger)
+	if discoveryDataErr != nil {
+		t.Fatalf("Failed to create combined discovery data: %s", discoveryDataErr)
+	}
+	resolvedData, resolvedDataErr := resolveDiscoveryData(discoveryData)
+	if resolvedDataErr != nil {
+		t.Fatalf("Failed to resolve combined discovery data: %s", resolvedDataErr)
+	}
+	var resources map[string]DiscoveryResource
+	unmarshalErr := json.Unmarshal([]byte(resolvedData), &resources)
+	if unmarshalErr != nil {
+		t.Fatalf("Failed to unmarshal combined discovery data: %s\n%s", unmarshalErr, resolvedData)
+	}
+	if len(resources) != 2 ||
+		resources["MyQueue"].Properties["Arn"] != "MyQueue.Arn" ||
+		resources["MyVolume"].ResourceType != "AWS::EC2::Volume" {
+		t.Errorf("Unexpected combined discovery data: %#v", resources)
+	}
+}
+
+func TestSafeMergeTemplatesEmptyDestination(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	sourceTemplate := gocf.NewTemplate()
+	sourceTemplate.AddResource("Queue", &gocf.SQSQueue{})
+	sourceTemplate.Outputs["QueueArn"] = &gocf.Output{
+		Value: gocf.GetAtt("Queue", "Arn"),
+	}
+	destTemplate := &gocf.Template{}
+	mergeErr := safeMergeTemplates(sourceTemplate, destTemplate, logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge into empty template: %s", mergeErr)
+	}
+	if len(destTemplate.Resources) != 1 || len(destTemplate.Outputs) != 1 {
+		t.Errorf("Unexpected merged template: %#v", destTemplate)
+	}
+}
+
+func TestResourceOutputsSorted(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	outputs, _ := resourceOutputs("MyInstance", &gocf.EC2Instance{}, true, logger)
+	if !sort.StringsAreSorted(outputs) {
+		t.Errorf("Unsorted resource outputs: %#v", outputs)
+	}
+}
+
+func TestDiscoveryResourceInfoEmptyName(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("", &gocf.SNSTopic{})
+	discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template, "", nil, logger)
+	if discoveryDataErr == nil || discoveryData != nil {
+		t.Errorf("Failed to reject empty resource name: %s", string(discoveryData))
+	}
+	discoveryData, discoveryDataErr = discoveryResourceJSONForDependency(template, "", nil, logger)
+	if discoveryDataErr == nil || discoveryData != nil {
+		t.Errorf("Failed to reject empty resource name: %s", string(discoveryData))
+	}
+}
+
+func TestResourceOutputsStrictDiscovery(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	_, outputsErr := resourceOutputs("MyVolume", &gocf.EC2Volume{}, false, logger)
+	if outputsErr != nil {
+		t.Fatalf("Unexpected error for non-strict discovery: %s", outputsErr)
+	}
+	StrictDiscovery = true
+	defer func() {
+		StrictDiscovery = false
+	}()
+	_, outputsErr = resourceOutputs("MyVolume", &gocf.EC2Volume{}, false, logger)
+	if outputsErr == nil {
+		t.Errorf("Failed to reject unsupported resource type with StrictDiscovery")
+	}
+}
+
+func TestDiscoveryAllowedResourceTypes(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	template.AddResource("MySecret", &testAWSResource{
+		resourceType: "AWS::SecretsManager::Secret",
+	})
+	options := &discoveryOptions{
+		allowedResourceTypes: map[string]bool{
+			"AWS::SQS::Queue": true,
+		},
+	}
+	_, queueErr := discoveryResourceJSONForDependency(template, "MyQueue", options, logger)
+	if queueErr != nil {
+		t.Errorf("Failed to create allowed discovery data: %s", queueErr)
+	}
+	_, secretErr := discoveryResourceJSONForDependency(template, "MySecret", options, logger)
+	if secretErr == nil {
+		t.Errorf("Failed to reject disallowed resource type")
+	}
+	_, secretDefaultErr := discoveryResourceJSONForDependency(template, "MySecret", nil, logger)
+	if secretDefaultErr != nil {
+		t.Errorf("Failed to create discovery data without an allowlist: %s", secretDefaultErr)
+	}
+}
+
+func TestDiscoveryResourceInfoTemplateDelimiters(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("My<<Queue>>", &gocf.SQSQueue{})
+
+	discoveryData, discoveryDataErr := discoveryResourceJSONForDependency(template,
+		"My<<Queue>>",
+		nil,
+		logger)
+	if discoveryDataErr != nil {
+		t.Fatalf("Failed to create discovery data: %s", discoveryDataErr)
+	}
+	resource := resolveDiscoveryResource(t, discoveryData)
+	if resource.ResourceID != "My<<Queue>>" ||
+		resource.ResourceRef != "physical-My<<Queue>>" {
+		t.Errorf("Unexpected discovery resource: %#v", resource)
+	}
+}
+
+func TestDiscoveryNestedStackTemplate(t *testing.T) {
+	template := gocf.NewTemplate()
+	template.AddResource("MyStack", &NestedStack{
+		CloudFormationStack: gocf.CloudFormationStack{
+			TemplateURL: gocf.String("https://s3.amazonaws.com/bucket/child.json"),
+		},
+		Outputs: []string{"Endpoint"},
+	})
+	// The declared outputs aren't part of the resource definition
+	templateJSON, templateJSONErr := json.Marshal(template)
+	if templateJSONErr != nil {
+		t.Fatalf("Failed to marshal template: %s", templateJSONErr)
+	}
+	if bytes.Contains(templateJSON, []byte(`"Outputs":["Endpoint"]`)) {
+		t.Errorf("Unexpected declared outputs in template: %s", templateJSON)
+	}
+}
+
+func TestSafeMergeTemplatesOrder(t *testing.T) {
+	logger, _ := NewLogger("debug")
+	var logOutput bytes.Buffer
+	logger.Out = &logOutput
+	logger.Formatter = &logrus.JSONFormatter{}
+
+	sourceTemplate := gocf.NewTemplate()
+	for _, eachName := range []string{"Delta", "Alpha", "Charlie", "Bravo"} {
+		sourceTemplate.AddResource(eachName, &gocf.SQSQueue{})
+	}
+	mergeErr := safeMergeTemplates(sourceTemplate, gocf.NewTemplate(), logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge templates: %s", mergeErr)
+	}
+	mergedNames := []string{}
+	decoder := json.NewDecoder(&logOutput)
+	for decoder.More() {
+		var logEntry map[string]interface{}
+		if decodeErr := decoder.Decode(&logEntry); decodeErr != nil {
+			t.Fatalf("Failed to decode log entry: %s", decodeErr)
+		}
+		if logEntry["msg"] == "Merging CloudFormation template entry" {
+			mergedNames = append(mergedNames, logEntry["Name"].(string))
+		}
+	}
+	if !reflect.DeepEqual(mergedNames, []string{"Alpha", "Bravo", "Charlie", "Delta"}) {
+		t.Errorf("Unexpected merge order: %#v", mergedNames)
+	}
+}
+
+func TestResourceOutputsUnsupportedResourceHandler(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	unsupportedResources := make(map[string]string)
+	UnsupportedResourceHandler = func(resourceName string, resourceType string) {
+		unsupportedResources[resourceName] = resourceType
+	}
+	defer func() {
+		UnsupportedResourceHandler = nil
+	}()
+
+	_, outputsErr := resourceOutputs("MyVolume", &gocf.EC2Volume{}, false, logger)
+	if outputsErr != nil {
+		t.Fatalf("Unexpected error for unsupported resource: %s", outputsErr)
+	}
+	_, outputsErr = resourceOutputs("MyQueue", &gocf.SQSQueue{}, false, logger)
+	if outputsErr != nil {
+		t.Fatalf("Failed to get SQS outputs: %s", outputsErr)
+	}
+	// Strict discovery reports an error instead
+	_, outputsErr = resourceOutputs("MyStrictVolume", &gocf.EC2Volume{}, true, logger)
+	if outputsErr == nil {
+		t.Errorf("Failed to reject unsupported resource in strict mode")
+	}
+	if !reflect.DeepEqual(unsupportedResources, map[string]string{"MyVolume": "AWS::EC2::Volume"}) {
+		t.Errorf("Unexpected unsupported resources: %#v", unsupportedResources)
+	}
+}
+
+func TestDiscoveryEmbedInfo(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	lambdaResource := &gocf.LambdaFunction{}
+
+	embedErr := embedDiscoveryInfo("MyFunction",
+		lambdaResource,
+		template,
+		[]string{"MyQueue"},
+		"",
+		nil,
+		logger)
+	if embedErr != nil {
+		t.Fatalf("Failed to embed discovery info: %s", embedErr)
+	}
+	environmentVars, _ := lambdaResource.Environment.Variables.(map[string]*gocf.StringExpr)
+	if environmentVars[spartaEnvVarDiscoveryInformation] == nil {
+		t.Fatalf("Missing discovery info environment variable: %#v", lambdaResource.Environment)
+	}
+	discoveryInfoData := resolveDiscoveryInfo(t, environmentVars[spartaEnvVarDiscoveryInformation])
+	if discoveryInfoData.ResourceID != "MyFunction" ||
+		discoveryInfoData.Resources["MyQueue"].ResourceRef != "physical-MyQueue" {
+		t.Errorf("Unexpected DiscoveryInfo: %#v", discoveryInfoData)
+	}
+
+	embedErr = embedDiscoveryInfo("MyFunction",
+		lambdaResource,
+		template,
+		[]string{"MissingQueue"},
+		"",
+		nil,
+		logger)
+	if embedErr == nil {
+		t.Errorf("Failed to reject undefined dependency")
+	}
+}
+
+func TestDiscoveryAnnotateMissingDependency(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	lambdaFn := HandleAWSLambda("MyFunction", nil, IAMRoleDefinition{})
+	lambdaFn.DependsOn = []string{"MyQueue", "MissingQueue"}
+
+	_, annotateErr := annotateDiscoveryInfo(lambdaFn, template, logger)
+	if annotateErr == nil {
+		t.Errorf("Failed to reject undefined dependency")
+	}
+	lambdaFn.DependsOn = []string{"MyQueue"}
+	_, annotateErr = annotateDiscoveryInfo(lambdaFn, template, logger)
+	if annotateErr != nil {
+		t.Fatalf("Failed to annotate discovery info: %s", annotateErr)
+	}
+	discoveryInfoData := resolveDiscoveryInfo(t,
+		lambdaFn.Options.Environment[spartaEnvVarDiscoveryInformation])
+	if discoveryInfoData.Resources["MyQueue"].ResourceRef != "physical-MyQueue" {
+		t.Errorf("Unexpected DiscoveryInfo: %#v", discoveryInfoData)
+	}
+}
+
+func TestDiscoveryAnnotateResourceTypes(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	template.AddResource("MyTopic", &gocf.SNSTopic{})
+	lambdaFn := HandleAWSLambda("MyFunction", nil, IAMRoleDefinition{})
+	lambdaFn.Options = &LambdaFunctionOptions{
+		DiscoveryResourceTypes: []string{"AWS::SQS::Queue"},
+	}
+	lambdaFn.DependsOn = []string{"MyQueue", "MyTopic"}
+
+	_, annotateErr := annotateDiscoveryInfo(lambdaFn, template, logger)
+	if annotateErr == nil {
+		t.Errorf("Failed to reject disallowed resource type")
+	}
+	lambdaFn.DependsOn = []string{"MyQueue"}
+	_, annotateErr = annotateDiscoveryInfo(lambdaFn, template, logger)
+	if annotateErr != nil {
+		t.Fatalf("Failed to annotate allowed resource type: %s", annotateErr)
+	}
+	discoveryInfoData := resolveDiscoveryInfo(t,
+		lambdaFn.Options.Environment[spartaEnvVarDiscoveryInformation])
+	if discoveryInfoData.Resources["MyQueue"].ResourceType != "AWS::SQS::Queue" {
+		t.Errorf("Unexpected DiscoveryInfo: %#v", discoveryInfoData)
+	}
+}
+
+func TestDiscoveryAnnotateStaticProperties(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	lambdaFn := HandleAWSLambda("MyFunction", nil, IAMRoleDefinition{})
+	lambdaFn.Options = &LambdaFunctionOptions{
+		DiscoveryStaticProperties: map[string]string{
+			"Stage": `"production"`,
+		},
+	}
+	lambdaFn.DependsOn = []string{"MyQueue"}
+
+	_, annotateErr := annotateDiscoveryInfo(lambdaFn, template, logger)
+	if annotateErr != nil {
+		t.Fatalf("Failed to annotate discovery info: %s", annotateErr)
+	}
+	discoveryInfoData := resolveDiscoveryInfo(t,
+		lambdaFn.Options.Environment[spartaEnvVarDiscoveryInformation])
+	queueProperties := discoveryInfoData.Resources["MyQueue"].Properties
+	if queueProperties["Stage"] != `"production"` ||
+		queueProperties["Arn"] != "MyQueue.Arn" {
+		t.Errorf("Unexpected static discovery properties: %#v", queueProperties)
+	}
+}
+
+func TestDiscoveryDataTemplateCached(t *testing.T) {
+	firstTemplate, firstTemplateErr := parsedDiscoveryDataTemplate()
+	if firstTemplateErr != nil {
+		t.Fatalf("Failed to parse discovery data template: %s", firstTemplateErr)
+	}
+	secondTemplate, _ := parsedDiscoveryDataTemplate()
+	if firstTemplate != secondTemplate {
+		t.Errorf("Discovery data template was parsed more than once")
+	}
+}
+
+func TestDiscoveryInfoValidation(t *testing.T) {
+	_, discoveryInfoErr := discoveryInfoForResource("MyFunction", []byte(`{"MyQueue":}`))
+	if discoveryInfoErr == nil {
+		t.Errorf("Failed to reject empty dependency discovery data")
+	}
+}
+
+func TestDiscoveryEmbedInfoEnvironmentKey(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	environmentVars := map[string]*gocf.StringExpr{
+		spartaEnvVarDiscoveryInformation: gocf.String("third-party"),
+	}
+	lambdaResource := &gocf.LambdaFunction{
+		Environment: &gocf.LambdaFunctionEnvironment{
+			Variables: environmentVars,
+		},
+	}
+	embedErr := embedDiscoveryInfo("MyFunction",
+		lambdaResource,
+		template,
+		[]string{"MyQueue"},
+		"MY_DISCOVERY_INFO",
+		nil,
+		logger)
+	if embedErr != nil {
+		t.Fatalf("Failed to embed discovery info: %s", embedErr)
+	}
+	if environmentVars[spartaEnvVarDiscoveryInformation].Literal != "third-party" ||
+		environmentVars["MY_DISCOVERY_INFO"] == nil ||
+		environmentVars[spartaEnvVarDiscoveryKey].Literal != "MY_DISCOVERY_INFO" {
+		t.Errorf("Unexpected environment variables: %#v", environmentVars)
+	}
+	if discoveryEnvironmentKey(environmentVars) != "MY_DISCOVERY_INFO" {
+		t.Errorf("Unexpected discovery environment key: %s", discoveryEnvironmentKey(environmentVars))
+	}
+
+	// An existing variable isn't replaced
+	embedErr = embedDiscoveryInfo("MyFunction",
+		lambdaResource,
+		template,
+		[]string{"MyQueue"},
+		"MY_DISCOVERY_INFO",
+		nil,
+		logger)
+	if embedErr == nil {
+		t.Errorf("Failed to reject existing discovery environment variable")
+	}
+	embedErr = embedDiscoveryInfo("MyFunction",
+		lambdaResource,
+		template,
+		[]string{"MyQueue"},
+		"",
+		nil,
+		logger)
+	if embedErr == nil {
+		t.Errorf("Failed to reject existing default discovery environment variable")
+	}
+}
+
+func TestDiscoveryEnvironmentKeyReserved(t *testing.T) {
+	discoveryInfo := gocf.String("discovery")
+	environmentVars := make(map[string]*gocf.StringExpr)
+	setErr := setDiscoveryEnvironment(environmentVars, spartaEnvVarDiscoveryKey, discoveryInfo)
+	if setErr == nil {
+		t.Errorf("Failed to reject reserved discovery environment key")
+	}
+
+	defaultKey := DiscoveryEnvironmentKey
+	defer func() {
+		DiscoveryEnvironmentKey = defaultKey
+	}()
+	DiscoveryEnvironmentKey = ""
+	setErr = setDiscoveryEnvironment(environmentVars, "", discoveryInfo)
+	if setErr == nil {
+		t.Errorf("Failed to reject empty DiscoveryEnvironmentKey")
+	}
+	if len(environmentVars) != 0 {
+		t.Errorf("Unexpected environment variables: %#v", environmentVars)
+	}
+}
+
+func TestTemplateSize(t *testing.T) {
+	template := gocf.NewTemplate()
+	template.AddResource("MyQueue", &gocf.SQSQueue{})
+	templateJSON, _ := json.Marshal(template)
+
+	sizeErr := checkTemplateSize(templateJSON, len(templateJSON))
+	if sizeErr != nil {
+		t.Fatalf("Failed to check template size: %s", sizeErr)
+	}
+	sizeErr = checkTemplateSize(templateJSON, len(templateJSON)-1)
+	if sizeErr == nil {
+		t.Errorf("Failed to reject template that exceeds size limit")
+	}
+	sizeErr = checkTemplateSize(templateJSON, 0)
+	if sizeErr != nil {
+		t.Errorf("Unexpected error without a size limit: %s", sizeErr)
+	}
+}
+
+func TestSafeMergeTemplatesRenameOutputs(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	newTemplate := func(stackName string) *gocf.Template {
+		template := gocf.NewTemplate()
+		template.Outputs["StackName"] = &gocf.Output{
+			Value: gocf.String(stackName),
+		}
+		return template
+	}
+	sourceTemplate := newTemplate("source")
+	sourceTemplate.Outputs["StackName2"] = &gocf.Output{
+		Value: gocf.String("source2"),
+	}
+	destTemplate := newTemplate("dest")
+
+	summary, mergeErr := safeMergeTemplatesWithSummary(sourceTemplate,
+		destTemplate,
+		&TemplateMergeOptions{
+			RenameOutputs: true,
+		},
+		logger)
+	if mergeErr != nil {
+		t.Fatalf("Failed to merge colliding outputs: %s", mergeErr)
+	}
+	if !reflect.DeepEqual(summary.RenamedOutputs, map[string]string{"StackName": "StackName3"}) {
+		t.Errorf("Unexpected renamed outputs: %#v", summary.RenamedOutputs)
+	}
+	if !reflect.DeepEqual(summary.Outputs, []string{"StackName2", "StackName3"}) {
+		t.Errorf("Unexpected merged outputs: %#v", summary.Outputs)
+	}
+	if !reflect.DeepEqual(destTemplate.Outputs["StackName"].Value, gocf.String("dest")) ||
+		!reflect.DeepEqual(destTemplate.Outputs["StackName3"].Value, gocf.String("source")) {
+		t.Errorf("Unexpected destination outputs: %#v", destTemplate.Outputs)
+	}
+	if _, sourceOk := sourceTemplate.Outputs["StackName3"]; sourceOk {
+		t.Errorf("Unexpected modification of source outputs: %#v", sourceTemplate.Outputs)
+	}
+}
@@ -31,6 +31,70 @@ type DiscoveryResource struct {
 // END - DiscoveryResource
 ////////////////////////////////////////////////////////////////////////////////
 
+////////////////////////////////////////////////////////////////////////////////
+// START - SQSDiscoveryResource
+//
+
+// SQSDiscoveryResource is the typed discovery information for an
+// AWS::SQS::Queue resource
+type SQSDiscoveryResource struct {
+	Arn       string
+	QueueName string
+	QueueURL  string
+}
+
+// NewSQSDiscoveryResource returns the typed SQS queue discovery information
+// from the DiscoveryResource. An error is returned if the resource isn't
+// an SQS queue or any of the expected properties are missing.
+func NewSQSDiscoveryResource(resource DiscoveryResource) (*SQSDiscoveryResource, error) {
+	if resource.ResourceType != "AWS::SQS::Queue" {
+		return nil, fmt.Errorf("Discovery resource %s is not an SQS queue: %s",
+			resource.ResourceID,
+			resource.ResourceType)
+	}
+	propertyValue := func(propertyName string) (string, error) {
+		value, valueOk := resource.Properties[propertyName]
+		if !valueOk {
+			return "", fmt.Errorf("Discovery resource %s is missing SQS property: %s",
+				resource.ResourceID,
+				propertyName)
+		}
+		return value, nil
+	}
+	queueArn, queueArnErr := propertyValue("Arn")
+	if queueArnErr != nil {
+		return nil, queueArnErr
+	}
+	queueName, queueNameErr := propertyValue("QueueName")
+	if queueNameErr != nil {
+		return nil, queueNameErr
+	}
+	queueURL, queueURLErr := propertyValue("QueueUrl")
+	if queueURLErr != nil {
+		return nil, queueURLErr
+	}
+	return &SQSDiscoveryResource{
+		Arn:       queueArn,
+		QueueName: queueName,
+		QueueURL:  queueURL,
+	}, nil
+}
+
+// ParseSQSDiscoveryResource unmarshals the JSON discovery information for
+// a single dependency and returns the typed SQS queue discovery information
+func ParseSQSDiscoveryResource(discoveryData []byte) (*SQSDiscoveryResource, error) {
+	var resource DiscoveryResource
+	unmarshalErr := json.Unmarshal(discoveryData, &resource)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return NewSQSDiscoveryResource(resource)
+}
+
+//
+// END - SQSDiscoveryResource
+////////////////////////////////////////////////////////////////////////////////
+
 ////////////////////////////////////////////////////////////////////////////////
 // START - DiscoveryInfo
 //
@@ -77,7 +141,11 @@ func initializeDiscovery(logger *logrus.Logger) {
 		cachedDiscoveryInfo = &DiscoveryInfo{}
 
 		// Get the serialized discovery info the environment string
-		discoveryInfo := os.Getenv(spartaEnvVarDiscoveryInformation)
+		discoveryKey := os.Getenv(spartaEnvVarDiscoveryKey)
+		if discoveryKey == "" {
+			discoveryKey = DiscoveryEnvironmentKey
+		}
+		discoveryInfo := os.Getenv(discoveryKey)
 		decoded, decodedErr := base64.StdEncoding.DecodeString(discoveryInfo)
 		logger.WithFields(logrus.Fields{
 			"DecodeData":  string(decoded),
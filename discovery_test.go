@@ -78,3 +78,53 @@ func TestDiscoveryEmptyMetadata(t *testing.T) {
 	}
 	t.Logf("Discovery Info: %#v", info)
 }
+
+func TestDiscoverySQSResource(t *testing.T) {
+	discoveryData := `{
+		"ResourceID" : "MyQueue",
+		"ResourceRef" : "https://sqs.us-west-2.amazonaws.com/123412341234/MyQueue",
+		"ResourceType" : "AWS::SQS::Queue",
+		"Properties" : {
+			"Arn" : "arn:aws:sqs:us-west-2:123412341234:MyQueue",
+			"QueueName" : "MyQueue",
+			"QueueUrl" : "https://sqs.us-west-2.amazonaws.com/123412341234/MyQueue"
+		}
+	}`
+	queueInfo, queueInfoErr := ParseSQSDiscoveryResource([]byte(discoveryData))
+	if queueInfoErr != nil {
+		t.Fatalf("Failed to parse SQS discovery data: %s", queueInfoErr)
+	}
+	if queueInfo.QueueName != "MyQueue" {
+		t.Errorf("Unexpected SQS discovery info: %#v", queueInfo)
+	}
+	_, queueInfoErr = NewSQSDiscoveryResource(DiscoveryResource{
+		ResourceID:   "MyQueue",
+		ResourceType: "AWS::SQS::Queue",
+	})
+	if queueInfoErr == nil {
+		t.Errorf("Failed to reject SQS discovery data without properties")
+	}
+}
+
+func TestDiscoveryEnvironmentKey(t *testing.T) {
+	logger, _ := NewLogger("warning")
+	encodedString := base64.StdEncoding.EncodeToString([]byte(discoveryDataNoTags))
+	os.Setenv(spartaEnvVarDiscoveryKey, "MY_DISCOVERY_INFO")
+	os.Setenv("MY_DISCOVERY_INFO", encodedString)
+	existingInfo := cachedDiscoveryInfo
+	cachedDiscoveryInfo = nil
+	defer func() {
+		os.Unsetenv(spartaEnvVarDiscoveryKey)
+		os.Unsetenv("MY_DISCOVERY_INFO")
+		cachedDiscoveryInfo = existingInfo
+	}()
+
+	initializeDiscovery(logger)
+	info, infoErr := Discover()
+	if infoErr != nil {
+		t.Fatalf("Failed to discover info from custom environment key: %s", infoErr)
+	}
+	if info.StackName != "SpartaDDB-mweagle" {
+		t.Errorf("Unexpected discovery info: %#v", info)
+	}
+}
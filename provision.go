@@ -985,38 +985,44 @@ var discoveryData = `
 	"Region": "{"Ref" : "AWS::Region"}",
 	"StackID": "{"Ref" : "AWS::StackId"}",
 	"StackName": "{"Ref" : "AWS::StackName"}",
-	"Resources":{<<range $eachDepResource, $eachOutputString := .Resources>>
-		"<< $eachDepResource >>" : << $eachOutputString >><< trailingComma >><<end>>
-	}
+	"Resources": << .Resources >>
 }`
 
 //
 type discoveryDataTemplateData struct {
 	TagLogicalResourceID string
-	Resources            map[string]string
+	Resources            string
+}
+
+var discoveryDataTemplateOnce sync.Once
+var discoveryDataTemplateParsed *template.Template
+var discoveryDataTemplateErr error
+
+// parsedDiscoveryDataTemplate returns the parsed discoveryData template.
+// The template is only parsed once and shared across functions.
+func parsedDiscoveryDataTemplate() (*template.Template, error) {
+	discoveryDataTemplateOnce.Do(func() {
+		discoveryDataTemplateParsed, discoveryDataTemplateErr = template.New("discoveryData").
+			Delims(discoveryTemplateLeftDelim, discoveryTemplateRightDelim).
+			Parse(discoveryData)
+		if discoveryDataTemplateErr != nil {
+			discoveryDataTemplateErr = fmt.Errorf("Failed to parse discovery data template: %s",
+				discoveryDataTemplateErr)
+		}
+	})
+	return discoveryDataTemplateParsed, discoveryDataTemplateErr
 }
 
-func discoveryInfoForResource(resID string, deps map[string]string) (*gocf.StringExpr, error) {
+// discoveryInfoForResource returns the discovery information for resID,
+// where resourcesData is the combined discovery information for its
+// dependencies returned by discoveryInfoForDependencies
+func discoveryInfoForResource(resID string, resourcesData []byte) (*gocf.StringExpr, error) {
 	discoveryDataTemplateData := &discoveryDataTemplateData{
 		TagLogicalResourceID: resID,
-		Resources:            deps,
-	}
-	totalDeps := len(deps)
-	var templateFuncMap = template.FuncMap{
-		// The name "inc" is what the function will be called in the template text.
-		"trailingComma": func() string {
-			totalDeps--
-			if totalDeps > 0 {
-				return ","
-			}
-			return ""
-		},
+		Resources:            string(resourcesData),
 	}
 
-	discoveryTemplate, discoveryTemplateErr := template.New("discoveryData").
-		Delims("<<", ">>").
-		Funcs(templateFuncMap).
-		Parse(discoveryData)
+	discoveryTemplate, discoveryTemplateErr := parsedDiscoveryDataTemplate()
 	if nil != discoveryTemplateErr {
 		return nil, discoveryTemplateErr
 	}
@@ -1026,6 +1032,10 @@ func discoveryInfoForResource(resID string, deps map[string]string) (*gocf.Strin
 	if nil != evalResultErr {
 		return nil, evalResultErr
 	}
+	validateErr := validateDiscoveryInfo(resID, templateResults.Bytes())
+	if validateErr != nil {
+		return nil, validateErr
+	}
 	templateReader := bytes.NewReader(templateResults.Bytes())
 	templateExpr, templateExprErr := spartaCF.ConvertToTemplateExpression(templateReader, nil)
 	if templateExprErr != nil {
@@ -1034,6 +1044,74 @@ func discoveryInfoForResource(resID string, deps map[string]string) (*gocf.Strin
 	return gocf.Base64(templateExpr), nil
 }
 
+// lambdaDiscoveryInfo returns the sparta.Discover information for the
+// Lambda function's dependencies. An error is returned if a dependency
+// isn't defined in the template.
+func lambdaDiscoveryInfo(lambdaResourceName string,
+	cfTemplate *gocf.Template,
+	dependencyNames []string,
+	options *discoveryOptions,
+	logger *logrus.Logger) (*gocf.StringExpr, error) {
+
+	for _, eachName := range dependencyNames {
+		if _, exists := cfTemplate.Resources[eachName]; !exists {
+			return nil, fmt.Errorf("Failed to resolve discovery information for %s dependency: %s",
+				lambdaResourceName,
+				eachName)
+		}
+	}
+	resourcesData, resourcesDataErr := discoveryInfoForDependencies(cfTemplate,
+		dependencyNames,
+		options,
+		logger)
+	if resourcesDataErr != nil {
+		return nil, resourcesDataErr
+	}
+	return discoveryInfoForResource(lambdaResourceName, resourcesData)
+}
+
+// embedDiscoveryInfo assigns the sparta.Discover information for the
+// dependencies to the Lambda function's environment. The function's
+// Environment is created if necessary. An empty environmentKey uses
+// DiscoveryEnvironmentKey. An error is returned if a dependency isn't
+// defined in the template.
+func embedDiscoveryInfo(lambdaResourceName string,
+	lambdaResource *gocf.LambdaFunction,
+	cfTemplate *gocf.Template,
+	dependencyNames []string,
+	environmentKey string,
+	options *discoveryOptions,
+	logger *logrus.Logger) error {
+
+	discoveryInfo, discoveryInfoErr := lambdaDiscoveryInfo(lambdaResourceName,
+		cfTemplate,
+		dependencyNames,
+		options,
+		logger)
+	if discoveryInfoErr != nil {
+		return discoveryInfoErr
+	}
+	if lambdaResource.Environment == nil {
+		lambdaResource.Environment = &gocf.LambdaFunctionEnvironment{}
+	}
+	if lambdaResource.Environment.Variables == nil {
+		lambdaResource.Environment.Variables = make(map[string]*gocf.StringExpr)
+	}
+	environmentVars, environmentVarsOk := lambdaResource.Environment.Variables.(map[string]*gocf.StringExpr)
+	if !environmentVarsOk {
+		return fmt.Errorf("Unsupported Environment Variables type for %s: %T",
+			lambdaResourceName,
+			lambdaResource.Environment.Variables)
+	}
+	setEnvironmentErr := setDiscoveryEnvironment(environmentVars, environmentKey, discoveryInfo)
+	if setEnvironmentErr != nil {
+		return fmt.Errorf("Failed to assign discovery information for %s: %s",
+			lambdaResourceName,
+			setEnvironmentErr)
+	}
+	return nil
+}
+
 func annotateBuildInformation(lambdaAWSInfo *LambdaAWSInfo,
 	template *gocf.Template,
 	buildID string,
@@ -1051,34 +1129,51 @@ func annotateBuildInformation(lambdaAWSInfo *LambdaAWSInfo,
 	return template, nil
 }
 
+// lambdaDiscoveryOptions returns the discoveryOptions for the Lambda
+// function's LambdaFunctionOptions
+func lambdaDiscoveryOptions(lambdaOptions *LambdaFunctionOptions) *discoveryOptions {
+	options := &discoveryOptions{
+		staticProperties: lambdaOptions.DiscoveryStaticProperties,
+	}
+	if len(lambdaOptions.DiscoveryResourceTypes) != 0 {
+		options.allowedResourceTypes = make(map[string]bool)
+		for _, eachType := range lambdaOptions.DiscoveryResourceTypes {
+			options.allowedResourceTypes[eachType] = true
+		}
+	}
+	return options
+}
+
 func annotateDiscoveryInfo(lambdaAWSInfo *LambdaAWSInfo,
 	template *gocf.Template,
 	logger *logrus.Logger) (*gocf.Template, error) {
-	depMap := make(map[string]string)
 
-	// Update the metdata with a reference to the output of each
-	// depended on item...
-	for _, eachDependsKey := range lambdaAWSInfo.DependsOn {
-		dependencyText, dependencyTextErr := discoveryResourceInfoForDependency(template, eachDependsKey, logger)
-		if dependencyTextErr != nil {
-			return nil, dependencyTextErr
-		}
-		depMap[eachDependsKey] = string(dependencyText)
-	}
 	if lambdaAWSInfo.Options == nil {
 		lambdaAWSInfo.Options = &LambdaFunctionOptions{}
 	}
-	lambdaEnvironment := lambdaAWSInfo.Options.Environment
-	if lambdaEnvironment == nil {
+	if lambdaAWSInfo.Options.Environment == nil {
 		lambdaAWSInfo.Options.Environment = make(map[string]*gocf.StringExpr)
 	}
-
-	discoveryInfo, discoveryInfoErr := discoveryInfoForResource(lambdaAWSInfo.logicalName(), depMap)
-	if discoveryInfoErr != nil {
-		return nil, discoveryInfoErr
+	// The exported LambdaFunction resource shares the Options.Environment
+	// map, so the discovery information is embedded via a proxy whose
+	// Variables are the same map
+	lambdaResource := &gocf.LambdaFunction{
+		Environment: &gocf.LambdaFunctionEnvironment{
+			Variables: lambdaAWSInfo.Options.Environment,
+		},
+	}
+	// Update the env map with a reference to the output of each
+	// depended on item...
+	embedErr := embedDiscoveryInfo(lambdaAWSInfo.logicalName(),
+		lambdaResource,
+		template,
+		lambdaAWSInfo.DependsOn,
+		lambdaAWSInfo.Options.DiscoveryEnvironmentKey,
+		lambdaDiscoveryOptions(lambdaAWSInfo.Options),
+		logger)
+	if embedErr != nil {
+		return nil, embedErr
 	}
-	// Update the env map
-	lambdaAWSInfo.Options.Environment[spartaEnvVarDiscoveryInformation] = discoveryInfo
 	return template, nil
 }
 
@@ -1290,6 +1385,14 @@ func applyCloudFormationOperation(ctx *workflowContext) (workflowStep, error) {
 		ctx.logger.Error("Failed to Marshal CloudFormation template: ", err.Error())
 		return nil, err
 	}
+	// Fail before anything is uploaded if the template is too large
+	ctx.logger.WithFields(logrus.Fields{
+		"Size": len(cfTemplate),
+	}).Debug("CloudFormation template size")
+	cfTemplateSizeErr := checkTemplateSize(cfTemplate, MaxTemplateSize)
+	if cfTemplateSizeErr != nil {
+		return nil, cfTemplateSizeErr
+	}
 
 	// Consistent naming of template
 	sanitizedServiceName := sanitizedName(ctx.userdata.serviceName)
@@ -1507,10 +1610,23 @@ func ensureCloudFormationStack() workflowStep {
 			if nil != decoratorError {
 				return nil, decoratorError
 			}
-			mergeErr := safeMergeTemplates(serviceTemplate, ctx.context.cfTemplate, ctx.logger)
+			preMergeTemplate := templateSnapshot(ctx.context.cfTemplate)
+			mergeErr := safeMergeTemplatesWithOptions(serviceTemplate,
+				ctx.context.cfTemplate,
+				ctx.userdata.workflowHooks.ServiceDecoratorMergeOptions,
+				ctx.logger)
 			if nil != mergeErr {
 				return nil, mergeErr
 			}
+			for eachSection, eachDiff := range diffTemplates(preMergeTemplate, ctx.context.cfTemplate) {
+				ctx.logger.WithFields(logrus.Fields{
+					"WorkflowHook": hookName,
+					"Section":      eachSection,
+					"Added":        eachDiff.Added,
+					"Changed":      eachDiff.Changed,
+					"Removed":      eachDiff.Removed,
+				}).Debug("ServiceDecorator template changes")
+			}
 		}
 		// Discovery info on a per-function basis
 		for _, eachEntry := range ctx.userdata.lambdaAWSInfos {
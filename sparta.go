@@ -48,6 +48,9 @@ const (
 	// spartaEnvVarDiscoveryInformation is the name of the discovery information
 	// published into the environment
 	spartaEnvVarDiscoveryInformation = "SPARTA_DISCOVERY_INFO"
+	// spartaEnvVarDiscoveryKey is the environment key that includes the
+	// name of the discovery information key, if it's not the default
+	spartaEnvVarDiscoveryKey = "SPARTA_DISCOVERY_INFO_KEY"
 	// spartaEnvVarBuildID is the environment key that includes the buildID
 	// that this was built with
 	spartaEnvVarBuildID = "SPARTA_BUILD_ID"
@@ -298,6 +301,16 @@ type LambdaFunctionOptions struct {
 	Tags map[string]string
 	// Tracing options for XRay
 	TracingConfig *gocf.LambdaFunctionTracingConfig
+	// Environment key for the sparta.Discover information. Defaults
+	// to DiscoveryEnvironmentKey. SPARTA_DISCOVERY_INFO_KEY is reserved.
+	DiscoveryEnvironmentKey string
+	// If non-empty, the CloudFormation resource types (eg, "AWS::SQS::Queue")
+	// that may publish sparta.Discover information to the function.
+	// Provisioning fails if a dependency has any other type.
+	DiscoveryResourceTypes []string
+	// Literal properties that are added to the sparta.Discover
+	// information for each of the function's dependencies
+	DiscoveryStaticProperties map[string]string
 	// Additional params
 	SpartaOptions *SpartaOptions
 }
@@ -399,6 +412,9 @@ type WorkflowHooks struct {
 	PreMarshall WorkflowHook
 	// ServiceDecorator is called before Sparta marshalls the CloudFormation template
 	ServiceDecorator ServiceDecoratorHook
+	// Options used to merge the ServiceDecorator template into the
+	// service template. A nil value uses the default options.
+	ServiceDecoratorMergeOptions *TemplateMergeOptions
 	// PostMarshall is called after Sparta marshalls the application contents to a CloudFormation template
 	PostMarshall WorkflowHook
 	// Rollback is called if there is an error performing the requested operation
@@ -688,6 +704,9 @@ type LambdaAWSInfo struct {
 	// Template decorator. If defined, the decorator will be called to insert additional
 	// resources on behalf of this lambda function
 	Decorator TemplateDecorator
+	// Options used to merge the Decorator template into the service
+	// template. A nil value uses the default options.
+	DecoratorMergeOptions *TemplateMergeOptions
 	// Optional array of infrastructure resource logical names, typically
 	// defined by a TemplateDecorator, that this lambda depends on
 	DependsOn []string
@@ -967,7 +986,10 @@ func (info *LambdaAWSInfo) export(serviceName string,
 			safeMetadataInsert(cfResource, info.logicalName(), metadataMap)
 		}
 		// Append the custom resources
-		err = safeMergeTemplates(decoratorProxyTemplate, template, logger)
+		err = safeMergeTemplatesWithOptions(decoratorProxyTemplate,
+			template,
+			info.DecoratorMergeOptions,
+			logger)
 		if nil != err {
 			return fmt.Errorf("Lambda (%s) decorator created conflicting resources", info.lambdaFunctionName())
 		}